@@ -0,0 +1,122 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// bmffBox is a box in the ISO base media file format (ISO/IEC 14496-12),
+// which is the container format for MP4, QuickTime, and HEIF files.
+type bmffBox struct {
+	typ    string // e.g., "moov"
+	offset int64  // offset of the box payload
+	size   int64  // size of the box payload
+}
+
+// readBoxes reads the sequence of boxes in r within the range [off, off+n).
+func readBoxes(r io.ReaderAt, off, n int64) ([]bmffBox, error) {
+	var boxes []bmffBox
+	for end := off + n; off < end; {
+		var hdr [16]byte
+		if end-off < 8 {
+			return boxes, errors.New("truncated box header")
+		}
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return boxes, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		box := bmffBox{typ: string(hdr[4:8]), offset: off + 8}
+		switch size {
+		case 0: // box extends to the end
+			size = end - off
+		case 1: // box uses a 64-bit size
+			if end-off < 16 {
+				return boxes, errors.New("truncated box header")
+			}
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return boxes, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			box.offset += 8
+		}
+		if size < box.offset-off || size > end-off {
+			return boxes, errors.New("invalid box size")
+		}
+		box.size = size - (box.offset - off)
+		boxes = append(boxes, box)
+		off += size
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of the given type.
+func findBox(boxes []bmffBox, typ string) (bmffBox, bool) {
+	for _, box := range boxes {
+		if box.typ == typ {
+			return box, true
+		}
+	}
+	return bmffBox{}, false
+}
+
+// readBoxData reads the entire payload of a box.
+func readBoxData(r io.ReaderAt, box bmffBox) ([]byte, error) {
+	if box.size > 64<<20 {
+		return nil, errors.New("box too large")
+	}
+	b := make([]byte, box.size)
+	if _, err := r.ReadAt(b, box.offset); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// bmffReader reads big-endian integers from a box payload.
+// Reading beyond the end of the payload produces zeros and
+// sets the err field.
+type bmffReader struct {
+	b   []byte
+	err error
+}
+
+func (r *bmffReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		r.b = nil
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *bmffReader) uint8() uint8   { return r.next(1)[0] }
+func (r *bmffReader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *bmffReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *bmffReader) uint64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+
+// uintN reads an n-byte integer, where n is 0, 4, or 8.
+func (r *bmffReader) uintN(n int) uint64 {
+	switch n {
+	case 0:
+		return 0
+	case 4:
+		return uint64(r.uint32())
+	case 8:
+		return r.uint64()
+	default:
+		r.err = errors.New("invalid integer size")
+		return 0
+	}
+}
+
+// fullBoxHeader reads the version and flags of a full box.
+func (r *bmffReader) fullBoxHeader() (version uint8, flags uint32) {
+	v := r.uint32()
+	return uint8(v >> 24), v & 0xffffff
+}
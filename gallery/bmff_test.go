@@ -0,0 +1,122 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// box returns an ISO-BMFF box of the given type with the concatenated payload.
+func box(typ string, payload ...[]byte) []byte {
+	b := bytes.Join(payload, nil)
+	return append(append(be32(uint32(8+len(b))), typ...), b...)
+}
+
+// fullBox returns an ISO-BMFF full box with the given version and flags.
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	return box(typ, append([][]byte{be32(uint32(version)<<24 | flags)}, payload...)...)
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func TestReadBoxes(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    []bmffBox
+		wantErr bool
+	}{{
+		name: "Empty",
+	}, {
+		name: "Sequence",
+		in:   concat(box("ftyp", []byte("heic")), box("free"), box("mdat", []byte("data"))),
+		want: []bmffBox{{"ftyp", 8, 4}, {"free", 20, 0}, {"mdat", 28, 4}},
+	}, {
+		name: "ExtendsToEnd",
+		in:   concat(box("ftyp"), be32(0), []byte("mdat"), []byte("abcdef")),
+		want: []bmffBox{{"ftyp", 8, 0}, {"mdat", 16, 6}},
+	}, {
+		name: "LargeSize",
+		in:   concat(be32(1), []byte("mdat"), be64(20), []byte("abcd")),
+		want: []bmffBox{{"mdat", 16, 4}},
+	}, {
+		name:    "TruncatedHeader",
+		in:      concat(box("ftyp"), []byte("\x00\x00\x00")),
+		want:    []bmffBox{{"ftyp", 8, 0}},
+		wantErr: true,
+	}, {
+		name:    "TruncatedLargeSize",
+		in:      concat(be32(1), []byte("mdat"), []byte("\x00\x00")),
+		wantErr: true,
+	}, {
+		name:    "OversizedLength",
+		in:      concat(be32(100), []byte("mdat"), []byte("abcd")),
+		wantErr: true,
+	}, {
+		name:    "UndersizedLength",
+		in:      concat(be32(4), []byte("mdat"), []byte("abcd")),
+		wantErr: true,
+	}, {
+		name:    "UndersizedLargeSize",
+		in:      concat(be32(1), []byte("mdat"), be64(8)),
+		wantErr: true,
+	}, {
+		name:    "NegativeLargeSize",
+		in:      concat(be32(1), []byte("mdat"), be64(1<<63)),
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBoxes(bytes.NewReader(tt.in), 0, int64(len(tt.in)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readBoxes error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readBoxes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBMFFReader(t *testing.T) {
+	br := &bmffReader{b: concat(be32(2<<24|0x000102), be16(3), be32(4), be64(5))}
+	version, flags := br.fullBoxHeader()
+	if version != 2 || flags != 0x000102 {
+		t.Errorf("fullBoxHeader = (%d, %#x), want (2, 0x102)", version, flags)
+	}
+	if got := br.uint16(); got != 3 {
+		t.Errorf("uint16 = %d, want 3", got)
+	}
+	if got := br.uintN(4); got != 4 {
+		t.Errorf("uintN(4) = %d, want 4", got)
+	}
+	if got := br.uintN(0); got != 0 {
+		t.Errorf("uintN(0) = %d, want 0", got)
+	}
+	if got := br.uintN(8); got != 5 {
+		t.Errorf("uintN(8) = %d, want 5", got)
+	}
+	if br.err != nil {
+		t.Fatalf("unexpected error: %v", br.err)
+	}
+	if got := br.uint32(); got != 0 || br.err == nil {
+		t.Errorf("uint32 past end = (%d, %v), want (0, error)", got, br.err)
+	}
+
+	br = &bmffReader{b: make([]byte, 8)}
+	br.uintN(2)
+	if br.err == nil {
+		t.Errorf("uintN(2) succeeded, want error")
+	}
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
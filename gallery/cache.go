@@ -0,0 +1,111 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// diskCache is a persistent cache of media metadata and previews that is
+// shared across all galleries, where entries are keyed by the content hash
+// of the media file. A nil *diskCache is a disabled cache.
+type diskCache struct {
+	dir string
+}
+
+// cacheEntry is the cached information for a single media file.
+type cacheEntry struct {
+	// Version is the metadataVersion that the metadata was loaded with.
+	Version int `json:",omitempty"`
+	// Timezone is the gallery time zone that the metadata was loaded with.
+	Timezone string `json:",omitempty"`
+	// MediaMetadata is metadata about the file and/or media.
+	MediaMetadata
+	// Previews are preview image sources keyed by the preview height.
+	Previews map[int]string
+}
+
+// openDiskCache opens the disk cache at dir.
+// If dir is empty, then a directory within os.UserCacheDir is used.
+// If dir is "off", then it returns a nil *diskCache.
+func openDiskCache(dir string) (*diskCache, error) {
+	switch dir {
+	case "off":
+		return nil, nil
+	case "":
+		d, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(d, "generate-gallery")
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	return &diskCache{dir: dir}, nil
+}
+
+// entryPath returns the file path of the cache entry for key.
+func (c *diskCache) entryPath(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// has reports whether there is a cache entry for key.
+func (c *diskCache) has(key string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	_, err := os.Stat(c.entryPath(key))
+	return err == nil
+}
+
+// load loads the cache entry for key.
+func (c *diskCache) load(key string) (cacheEntry, bool) {
+	var entry cacheEntry
+	if c == nil || key == "" {
+		return entry, false
+	}
+	b, err := os.ReadFile(c.entryPath(key))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return entry, false
+	}
+	return entry, true
+}
+
+// store stores the item in the cache entry for key, where the preview
+// is added to any previews of other heights already in the entry.
+func (c *diskCache) store(key string, item *Item, timezone string, height int) error {
+	if c == nil || key == "" {
+		return nil
+	}
+	entry, ok := c.load(key)
+	if !ok || entry.Previews == nil {
+		entry.Previews = make(map[int]string)
+	}
+	entry.Version = metadataVersion
+	entry.Timezone = timezone
+	entry.MediaMetadata = item.MediaMetadata
+	entry.Siblings = nil // siblings are not a property of the content
+	entry.Duplicates = nil
+	if item.PreviewSrc != "" && !isPlaceholderPreview(item.PreviewSrc) {
+		entry.Previews[height] = item.PreviewSrc
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Atomically write the entry since other processes may be reading it.
+	fp := c.entryPath(key)
+	if err := os.MkdirAll(filepath.Dir(fp), 0775); err != nil {
+		return err
+	}
+	return writeFileAtomic(fp, b, 0664)
+}
@@ -0,0 +1,284 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// maxChunkSize is the maximum size of a metadata chunk that is read.
+const maxChunkSize = 16 << 20
+
+// loadEmbeddedMetadata loads media-specific metadata from raw EXIF and XMP
+// data embedded within an image. The EXIF metadata takes precedence.
+// It populates item.MediaCreate and item.orientImage.
+func (item *Item) loadEmbeddedMetadata(exifData, xmpData []byte) error {
+	var err error
+	if len(exifData) > 0 {
+		var x *exif.Exif
+		if x, err = exif.Decode(bytes.NewReader(exifData)); err == nil {
+			err = item.loadEXIF(x)
+		}
+	}
+	if item.MediaCreate.IsZero() && len(xmpData) > 0 {
+		if t, ok := xmpDateTime(xmpData, item.location()); ok {
+			item.MediaCreate = t
+		}
+	}
+	return err
+}
+
+// loadPNGMetadata loads media-specific metadata from the
+// "eXIf" and "iTXt" XMP chunks of a PNG image.
+// It populates item.MediaCreate and item.orientImage.
+func loadPNGMetadata(ctx context.Context, item *Item, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var exifData, xmpData []byte
+	var hdr [8]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return err
+	}
+	for {
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch typ := string(hdr[4:8]); typ {
+		case "eXIf", "iTXt":
+			b, err := readChunk(f, size)
+			if err != nil {
+				return err
+			}
+			if typ == "eXIf" {
+				exifData = b
+			} else if b := pngXMP(b); b != nil {
+				xmpData = b
+			}
+			size = 0
+		case "IEND":
+			return item.loadEmbeddedMetadata(exifData, xmpData)
+		}
+		if _, err := f.Seek(size+4, io.SeekCurrent); err != nil { // skip data and CRC
+			return err
+		}
+	}
+	return item.loadEmbeddedMetadata(exifData, xmpData)
+}
+
+// pngXMP returns the XMP packet within an "iTXt" chunk.
+// It returns nil if the chunk does not contain XMP.
+func pngXMP(b []byte) []byte {
+	const keyword = "XML:com.adobe.xmp\x00"
+	if !bytes.HasPrefix(b, []byte(keyword)) || len(b) < len(keyword)+2 {
+		return nil
+	}
+	compressed := b[len(keyword)] == 1
+	b = b[len(keyword)+2:]
+	for i := 0; i < 2; i++ { // skip language tag and translated keyword
+		n := bytes.IndexByte(b, 0)
+		if n < 0 {
+			return nil
+		}
+		b = b[n+1:]
+	}
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil
+		}
+		b, err = io.ReadAll(io.LimitReader(zr, maxChunkSize))
+		if err != nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// loadWebPMetadata loads media-specific metadata from the
+// "EXIF" and "XMP " chunks of a WebP image.
+// It populates item.MediaCreate and item.orientImage.
+func loadWebPMetadata(ctx context.Context, item *Item, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var exifData, xmpData []byte
+	var hdr [12]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "RIFF" || string(hdr[8:12]) != "WEBP" {
+		return errors.New("invalid WebP header")
+	}
+	for {
+		if _, err := io.ReadFull(f, hdr[:8]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		skip := size + size&1 // chunks are padded to an even size
+		switch typ := string(hdr[:4]); typ {
+		case "EXIF", "XMP ":
+			b, err := readChunk(f, size)
+			if err != nil {
+				return err
+			}
+			if typ == "EXIF" {
+				exifData = b
+			} else {
+				xmpData = b
+			}
+			skip -= size
+		}
+		if _, err := f.Seek(skip, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	return item.loadEmbeddedMetadata(exifData, xmpData)
+}
+
+// loadGIFMetadata loads media-specific metadata from the
+// XMP application extension of a GIF image.
+// It populates item.MediaCreate.
+func loadGIFMetadata(ctx context.Context, item *Item, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	// Skip the header and the global color table (if any).
+	var hdr [13]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[10]&0x80 != 0 {
+		if _, err := r.Discard(3 << (hdr[10]&0x07 + 1)); err != nil {
+			return err
+		}
+	}
+
+	// Process each block.
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case 0x21: // extension
+			label, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if label != 0xff {
+				if err := skipGIFSubBlocks(r); err != nil {
+					return err
+				}
+				continue
+			}
+			var app [12]byte
+			if _, err := io.ReadFull(r, app[:]); err != nil {
+				return err
+			}
+			if string(app[:]) != "\x0bXMP DataXMP" {
+				if err := skipGIFSubBlocks(r); err != nil {
+					return err
+				}
+				continue
+			}
+			// The XMP packet is stored as raw bytes followed by a trailer
+			// crafted such that parsing the data as sub-blocks terminates.
+			// Thus, the packet is all of the data including the length bytes.
+			var xmp bytes.Buffer
+			for {
+				n, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					break
+				}
+				xmp.WriteByte(n)
+				if _, err := io.CopyN(&xmp, r, int64(n)); err != nil {
+					return err
+				}
+				if xmp.Len() > maxChunkSize {
+					return errors.New("XMP data too large")
+				}
+			}
+			return item.loadEmbeddedMetadata(nil, xmp.Bytes())
+		case 0x2c: // image descriptor
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return err
+			}
+			if desc[8]&0x80 != 0 {
+				if _, err := r.Discard(3 << (desc[8]&0x07 + 1)); err != nil {
+					return err
+				}
+			}
+			if _, err := r.Discard(1); err != nil { // LZW minimum code size
+				return err
+			}
+			if err := skipGIFSubBlocks(r); err != nil {
+				return err
+			}
+		case 0x3b: // trailer
+			return nil
+		default:
+			return errors.New("invalid GIF block")
+		}
+	}
+}
+
+// skipGIFSubBlocks skips a sequence of GIF data sub-blocks.
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// readChunk reads a metadata chunk of the given size.
+func readChunk(r io.Reader, size int64) ([]byte, error) {
+	if size > maxChunkSize {
+		return nil, errors.New("metadata chunk too large")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
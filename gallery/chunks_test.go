@@ -0,0 +1,244 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exifTIFF returns TIFF-encoded EXIF metadata with the given DateTimeOriginal.
+func exifTIFF(dateTimeOriginal string) []byte {
+	le := binary.LittleEndian
+	value := append([]byte(dateTimeOriginal), 0)
+	b, _ := tiffFile(le, 0, func(offs []uint32) [][]byte {
+		return [][]byte{
+			tiffIFD(le, 0, long(0x8769, offs[1])),                             // ExifIFDPointer
+			tiffIFD(le, 0, tiffEntry{0x9003, 2, uint32(len(value)), offs[2]}), // DateTimeOriginal
+			value,
+		}
+	})
+	return b
+}
+
+// xmpPacket returns an XMP packet with the given xmp:CreateDate.
+func xmpPacket(createDate string) []byte {
+	return []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF><rdf:Description xmp:CreateDate="` + createDate + `"/></rdf:RDF></x:xmpmeta>`)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	return concat(be32(uint32(len(data))), []byte(typ), data, []byte("CRC!"))
+}
+
+func pngITXt(xmp []byte, compressed bool) []byte {
+	flag := []byte{0, 0}
+	if compressed {
+		var bb bytes.Buffer
+		zw := zlib.NewWriter(&bb)
+		zw.Write(xmp)
+		zw.Close()
+		xmp, flag = bb.Bytes(), []byte{1, 0}
+	}
+	return pngChunk("iTXt", concat([]byte("XML:com.adobe.xmp\x00"), flag, []byte("\x00\x00"), xmp))
+}
+
+func webpChunk(typ string, data []byte) []byte {
+	b := concat([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data)
+	if len(data)%2 == 1 {
+		b = append(b, 0) // padding
+	}
+	return b
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	b := concat(chunks...)
+	return concat([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(b))), []byte("WEBP"), b)
+}
+
+// gifXMP returns a GIF application extension containing the XMP packet
+// followed by the "magic trailer" that makes the packet parse as sub-blocks.
+func gifXMP(xmp []byte) []byte {
+	trailer := []byte{0x01}
+	for i := 0xff; i >= 0; i-- {
+		trailer = append(trailer, byte(i))
+	}
+	return concat([]byte{0x21, 0xff}, []byte("\x0bXMP DataXMP"), xmp, trailer, []byte{0x00})
+}
+
+// gifFile returns a GIF image with a two-color global color table
+// and the provided blocks followed by the trailer.
+func gifFile(blocks ...[]byte) []byte {
+	hdr := concat([]byte("GIF89a"), []byte{1, 0, 1, 0, 0x80, 0, 0}, make([]byte, 6))
+	return concat(hdr, concat(blocks...), []byte{0x3b})
+}
+
+// gifImage is an image descriptor for a 1x1 image with a local color table.
+var gifImage = concat([]byte{0x2c, 0, 0, 0, 0, 1, 0, 1, 0, 0x80}, make([]byte, 6), []byte{0x02, 0x02, 0x44, 0x01, 0x00})
+
+func TestLoadChunkMetadata(t *testing.T) {
+	exifTime := time.Date(2021, 7, 4, 10, 0, 0, 0, time.UTC)
+	xmpTime := time.Date(2021, 7, 4, 10, 0, 0, 0, time.FixedZone("", -7*3600))
+	pngSig := []byte("\x89PNG\r\n\x1a\n")
+
+	tests := []struct {
+		name    string
+		decode  DecoderFunc
+		in      []byte
+		want    time.Time
+		wantErr bool
+	}{{
+		name:   "PNG/EXIF",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngChunk("IHDR", make([]byte, 13)), pngChunk("eXIf", exifTIFF("2021:07:04 10:00:00")), pngChunk("IEND", nil)),
+		want:   exifTime,
+	}, {
+		name:   "PNG/XMP",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngITXt(xmpPacket("2021-07-04T10:00:00-07:00"), false), pngChunk("IEND", nil)),
+		want:   xmpTime,
+	}, {
+		name:   "PNG/CompressedXMP",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngITXt(xmpPacket("2021-07-04T10:00:00-07:00"), true), pngChunk("IEND", nil)),
+		want:   xmpTime,
+	}, {
+		name:   "PNG/EXIFPrecedence",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngITXt(xmpPacket("2000-01-01T00:00:00Z"), false), pngChunk("eXIf", exifTIFF("2021:07:04 10:00:00")), pngChunk("IEND", nil)),
+		want:   exifTime,
+	}, {
+		name:   "PNG/OtherText",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngChunk("iTXt", []byte("Comment\x00\x00\x00\x00\x00hello")), pngChunk("IEND", nil)),
+	}, {
+		name:   "PNG/MissingIEND",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngITXt(xmpPacket("2021-07-04T10:00:00-07:00"), false)),
+		want:   xmpTime,
+	}, {
+		name:   "PNG/IgnoresAfterIEND",
+		decode: loadPNGMetadata,
+		in:     concat(pngSig, pngChunk("IEND", nil), pngITXt(xmpPacket("2021-07-04T10:00:00-07:00"), false)),
+	}, {
+		name:    "PNG/OversizedChunk",
+		decode:  loadPNGMetadata,
+		in:      concat(pngSig, be32(maxChunkSize+1), []byte("eXIf"), make([]byte, 16)),
+		wantErr: true,
+	}, {
+		name:    "PNG/TruncatedChunk",
+		decode:  loadPNGMetadata,
+		in:      concat(pngSig, be32(100), []byte("eXIf"), make([]byte, 16)),
+		wantErr: true,
+	}, {
+		name:    "PNG/TruncatedSignature",
+		decode:  loadPNGMetadata,
+		in:      pngSig[:4],
+		wantErr: true,
+	}, {
+		name:   "WebP/EXIF",
+		decode: loadWebPMetadata,
+		in:     webpFile(webpChunk("VP8X", make([]byte, 10)), webpChunk("EXIF", exifTIFF("2021:07:04 10:00:00"))),
+		want:   exifTime,
+	}, {
+		name:   "WebP/XMPAfterOddChunk",
+		decode: loadWebPMetadata,
+		in:     webpFile(webpChunk("VP8 ", make([]byte, 7)), webpChunk("XMP ", xmpPacket("2021-07-04T10:00:00-07:00"))),
+		want:   xmpTime,
+	}, {
+		name:   "WebP/NoMetadata",
+		decode: loadWebPMetadata,
+		in:     webpFile(webpChunk("VP8L", make([]byte, 5))),
+	}, {
+		name:    "WebP/InvalidHeader",
+		decode:  loadWebPMetadata,
+		in:      concat([]byte("RIFF"), make([]byte, 4), []byte("WAVE")),
+		wantErr: true,
+	}, {
+		name:    "WebP/OversizedChunk",
+		decode:  loadWebPMetadata,
+		in:      webpFile([]byte("EXIF"), binary.LittleEndian.AppendUint32(nil, maxChunkSize+1), make([]byte, 8)),
+		wantErr: true,
+	}, {
+		name:    "WebP/TruncatedChunk",
+		decode:  loadWebPMetadata,
+		in:      webpFile([]byte("XMP "), binary.LittleEndian.AppendUint32(nil, 100), make([]byte, 8)),
+		wantErr: true,
+	}, {
+		name:    "WebP/TruncatedChunkHeader",
+		decode:  loadWebPMetadata,
+		in:      webpFile([]byte("EXI")),
+		wantErr: true,
+	}, {
+		name:   "GIF/XMP",
+		decode: loadGIFMetadata,
+		in:     gifFile(gifXMP(xmpPacket("2021-07-04T10:00:00-07:00")), gifImage),
+		want:   xmpTime,
+	}, {
+		name:   "GIF/XMPAfterOtherBlocks",
+		decode: loadGIFMetadata,
+		in: gifFile(
+			[]byte{0x21, 0xff}, []byte("\x0bNETSCAPE2.0\x03\x01\x00\x00\x00"),
+			[]byte{0x21, 0xf9, 0x04, 0, 0, 0, 0, 0x00},
+			gifImage,
+			gifXMP(xmpPacket("2021-07-04T10:00:00-07:00")),
+		),
+		want: xmpTime,
+	}, {
+		name:   "GIF/NoXMP",
+		decode: loadGIFMetadata,
+		in:     gifFile(gifImage),
+	}, {
+		name:    "GIF/InvalidBlock",
+		decode:  loadGIFMetadata,
+		in:      gifFile([]byte{0x99}),
+		wantErr: true,
+	}, {
+		name:    "GIF/TruncatedImage",
+		decode:  loadGIFMetadata,
+		in:      gifFile(gifImage)[:len(gifFile(gifImage))-4],
+		wantErr: true,
+	}, {
+		name:    "GIF/TruncatedHeader",
+		decode:  loadGIFMetadata,
+		in:      []byte("GIF89a\x01\x00"),
+		wantErr: true,
+	}}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := filepath.Join(dir, "image")
+			if err := os.WriteFile(fp, tt.in, 0664); err != nil {
+				t.Fatal(err)
+			}
+			item := &Item{loc: time.UTC}
+			err := tt.decode(context.Background(), item, fp)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecodeMetadata error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := item.MediaCreate; !got.Equal(tt.want) || got.Format(time.RFC3339) != tt.want.Format(time.RFC3339) {
+				t.Errorf("MediaCreate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Every truncation of a valid file must fail gracefully.
+	t.Run("Truncated", func(t *testing.T) {
+		fp := filepath.Join(dir, "truncated")
+		for _, tt := range tests {
+			for i := 0; i < len(tt.in); i++ {
+				if err := os.WriteFile(fp, tt.in[:i], 0664); err != nil {
+					t.Fatal(err)
+				}
+				tt.decode(context.Background(), &Item{loc: time.UTC}, fp)
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// commandLimits are resource limits for child processes (e.g., ffmpeg).
+type commandLimits struct {
+	// threads is the number of threads that ffmpeg may use.
+	// If zero, ffmpeg chooses the number of threads.
+	threads int
+	// maxMemory is the maximum virtual address space in bytes of a process.
+	// If zero, memory usage is not limited.
+	maxMemory int64
+}
+
+// output runs the named program subject to the resource limits of the item
+// and returns its standard output. The process is killed if ctx is done.
+func (item *Item) output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return item.runCommand(ctx, false, name, args...)
+}
+
+// combinedOutput is like output, but returns both standard output
+// and standard error.
+func (item *Item) combinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return item.runCommand(ctx, true, name, args...)
+}
+
+func (item *Item) runCommand(ctx context.Context, combined bool, name string, args ...string) ([]byte, error) {
+	if name == "ffmpeg" && item.limits.threads > 0 {
+		args = append([]string{"-threads", strconv.Itoa(item.limits.threads)}, args...)
+	}
+	prog, progArgs := limitCommand(name, args, item.limits.maxMemory)
+	cmd := exec.CommandContext(ctx, prog, progArgs...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if combined {
+		cmd.Stderr = &out
+	}
+	logger := item.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Debug("running command", "cmd", cmd.String())
+	start := time.Now()
+	err := cmd.Run()
+	seconds := time.Since(start).Seconds()
+	item.commands = append(item.commands, CommandReport{Name: name, Seconds: seconds})
+	logger.Debug("finished command", "cmd", name, "seconds", seconds, "error", err)
+	return out.Bytes(), err
+}
@@ -0,0 +1,50 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRunCommandMaxMemory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("memory limits are only supported on Linux")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+
+	// The limit must be in effect as soon as the program starts.
+	item := &Item{limits: commandLimits{maxMemory: 64 << 20}}
+	out, err := item.output(context.Background(), "sh", "-c", "ulimit -v")
+	if err != nil {
+		t.Fatalf("output error: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "65536" {
+		t.Errorf("ulimit -v = %q, want %q", got, "65536")
+	}
+	if len(item.commands) != 1 || item.commands[0].Name != "sh" {
+		t.Errorf("commands = %v, want a single report for sh", item.commands)
+	}
+
+	// Arguments are passed through unmodified.
+	out, err = item.output(context.Background(), "printf", "%s|", "a b", "$1", "")
+	if err != nil {
+		t.Fatalf("output error: %v", err)
+	}
+	if got, want := string(out), "a b|$1||"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	// Missing programs are reported as such.
+	if _, err := item.output(context.Background(), "generate-gallery-missing"); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("output error = %v, want %v", err, exec.ErrNotFound)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// maxHashDistance is the maximum number of differing bits between
+// perceptual hashes for two images to be considered near duplicates.
+const maxHashDistance = 4
+
+// perceptualHash returns a difference hash (dHash) of an image,
+// which is a 64-bit hash where similar images have similar hashes.
+func perceptualHash(img image.Image) uint64 {
+	img = imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			l, _, _, _ := img.At(x, y).RGBA()
+			r, _, _, _ := img.At(x+1, y).RGBA()
+			hash <<= 1
+			if l > r {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// formatPerceptualHash formats a perceptual hash as a hex string.
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// findDuplicates returns clusters of indexes of items that are duplicates,
+// either because they have the same content hash or because they are
+// static images with a perceptual hash similar to that of the cluster's
+// representative. Comparing against only the representative (rather than
+// any member) avoids chaining together a series of gradually changing images.
+// Each cluster is sorted such that the preferred item is first,
+// which is the largest file (since copies are often recompressed).
+func findDuplicates(items []Item) [][]int {
+	// Visit items in order of preference so that the first item
+	// of each cluster is its representative.
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		ii, ij := items[order[i]], items[order[j]]
+		if ii.FileSize != ij.FileSize {
+			return ii.FileSize > ij.FileSize
+		}
+		return ii.Path < ij.Path
+	})
+
+	// Add each item to the cluster with identical content or else to the
+	// cluster with the nearest representative perceptual hash.
+	// Uniform images (with a hash of zero) are never similar.
+	var clusters [][]int
+	var reprHashes []uint64        // perceptual hash of each representative; zero if none
+	byHash := make(map[string]int) // content hash to cluster index
+	for _, i := range order {
+		item := items[i]
+		cluster := -1
+		if c, ok := byHash[item.ContentHash]; ok && item.ContentHash != "" {
+			cluster = c
+		}
+		var phash uint64
+		if f := formatFromExt(path.Ext(item.Path)); f != nil && !f.Video {
+			phash, _ = strconv.ParseUint(item.PerceptualHash, 16, 64)
+		}
+		if cluster < 0 && phash != 0 {
+			minDist := maxHashDistance + 1
+			for c, h := range reprHashes {
+				if d := bits.OnesCount64(phash ^ h); h != 0 && d < minDist {
+					cluster, minDist = c, d
+				}
+			}
+		}
+		if cluster < 0 {
+			cluster = len(clusters)
+			clusters = append(clusters, nil)
+			reprHashes = append(reprHashes, phash)
+		}
+		clusters[cluster] = append(clusters[cluster], i)
+		if item.ContentHash != "" {
+			if _, ok := byHash[item.ContentHash]; !ok {
+				byHash[item.ContentHash] = cluster
+			}
+		}
+	}
+
+	// Collect all clusters with more than one item.
+	var dups [][]int
+	for _, cluster := range clusters {
+		if len(cluster) > 1 {
+			dups = append(dups, cluster)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		return items[dups[i][0]].Path < items[dups[j][0]].Path
+	})
+	return dups
+}
+
+// loadPerceptualHash populates item.PerceptualHash from the preview image
+// for items that were processed before perceptual hashes were computed.
+func (item *Item) loadPerceptualHash() {
+	if item.PerceptualHash != "" || item.PreviewSrc == "" {
+		return
+	}
+	if f := formatFromExt(path.Ext(item.Path)); f == nil || f.Video {
+		return
+	}
+	_, data, err := decodeDataURI(item.PreviewSrc)
+	if err != nil {
+		return
+	}
+	if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+		item.PerceptualHash = formatPerceptualHash(perceptualHash(img))
+	}
+}
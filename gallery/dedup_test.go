@@ -0,0 +1,68 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []Item
+		want  [][]int
+	}{{
+		name: "ContentHash",
+		items: []Item{
+			{Path: "a.mov", MediaMetadata: MediaMetadata{FileSize: 10, ContentHash: "x"}},
+			{Path: "b.mov", MediaMetadata: MediaMetadata{FileSize: 10, ContentHash: "y"}},
+			{Path: "c.mov", MediaMetadata: MediaMetadata{FileSize: 10, ContentHash: "x"}},
+		},
+		want: [][]int{{0, 2}},
+	}, {
+		name: "PreferLargest",
+		items: []Item{
+			{Path: "a.jpg", MediaMetadata: MediaMetadata{FileSize: 10, PerceptualHash: "00000000000000ff"}},
+			{Path: "b.jpg", MediaMetadata: MediaMetadata{FileSize: 30, PerceptualHash: "00000000000000fe"}},
+			{Path: "c.jpg", MediaMetadata: MediaMetadata{FileSize: 20, PerceptualHash: "00000000000000ff"}},
+		},
+		want: [][]int{{1, 2, 0}},
+	}, {
+		// Each image is similar to the next, but the ends are not similar,
+		// so they must not be chained into a single cluster.
+		name: "NoChaining",
+		items: []Item{
+			{Path: "a.jpg", MediaMetadata: MediaMetadata{FileSize: 40, PerceptualHash: "000000000000000f"}},
+			{Path: "b.jpg", MediaMetadata: MediaMetadata{FileSize: 30, PerceptualHash: "00000000000000ff"}},
+			{Path: "c.jpg", MediaMetadata: MediaMetadata{FileSize: 20, PerceptualHash: "0000000000000fff"}},
+			{Path: "d.jpg", MediaMetadata: MediaMetadata{FileSize: 10, PerceptualHash: "000000000000ffff"}},
+		},
+		want: [][]int{{0, 1}, {2, 3}},
+	}, {
+		name: "NearestRepresentative",
+		items: []Item{
+			{Path: "a.jpg", MediaMetadata: MediaMetadata{FileSize: 30, PerceptualHash: "0000000000000007"}},
+			{Path: "b.jpg", MediaMetadata: MediaMetadata{FileSize: 20, PerceptualHash: "0000000000000070"}},
+			{Path: "c.jpg", MediaMetadata: MediaMetadata{FileSize: 10, PerceptualHash: "0000000000000031"}},
+		},
+		want: [][]int{{1, 2}},
+	}, {
+		name: "IgnoreUniformAndVideos",
+		items: []Item{
+			{Path: "a.jpg", MediaMetadata: MediaMetadata{PerceptualHash: "0000000000000000"}},
+			{Path: "b.jpg", MediaMetadata: MediaMetadata{PerceptualHash: "0000000000000000"}},
+			{Path: "c.mov", MediaMetadata: MediaMetadata{PerceptualHash: "00000000000000ff"}},
+			{Path: "d.mov", MediaMetadata: MediaMetadata{PerceptualHash: "00000000000000ff"}},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findDuplicates(tt.items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findDuplicates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 fields for the time zone offset of the EXIF timestamps,
+// which are not known to the exif package.
+const (
+	exifOffsetTime         exif.FieldName = "OffsetTime"
+	exifOffsetTimeOriginal exif.FieldName = "OffsetTimeOriginal"
+)
+
+var exifOffsetTimeFields = map[uint16]exif.FieldName{
+	0x9010: exifOffsetTime,
+	0x9011: exifOffsetTimeOriginal,
+}
+
+// exifDateTime returns the creation time according to the EXIF metadata.
+// It returns the zero value if the EXIF metadata has no creation time.
+//
+// EXIF timestamps are in local time without any time zone information.
+// The time zone is determined from the OffsetTimeOriginal or OffsetTime tags,
+// otherwise by comparing against the GPS timestamp (which is in UTC),
+// otherwise the timestamp is interpreted in the provided location.
+func exifDateTime(x *exif.Exif, loc *time.Location) (time.Time, error) {
+	tag, err := x.Get(exif.DateTimeOriginal)
+	offsetFields := []exif.FieldName{exifOffsetTimeOriginal, exifOffsetTime}
+	if err != nil {
+		tag, err = x.Get(exif.DateTime)
+		offsetFields = []exif.FieldName{exifOffsetTime, exifOffsetTimeOriginal}
+		if err != nil {
+			return time.Time{}, nil
+		}
+	}
+	if tag.Format() != tiff.StringVal {
+		return time.Time{}, errors.New("DateTime[Original] not in string format")
+	}
+	s := strings.TrimRight(string(tag.Val), "\x00 ")
+	if s == "" || strings.HasPrefix(s, "0000:00:00") {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Determine the time zone offset from the EXIF offset tags.
+	loadEXIFSubDir(x, exif.ExifIFDPointer, exifOffsetTimeFields)
+	for _, name := range offsetFields {
+		if tag, err := x.Get(name); err == nil {
+			s, _ := tag.StringVal()
+			if tz, err := time.Parse("-07:00", strings.TrimSpace(s)); err == nil {
+				_, offset := tz.Zone()
+				return withLocation(t, time.FixedZone("", offset)), nil
+			}
+		}
+	}
+
+	// Determine the time zone offset from the GPS timestamp.
+	if utc, ok := exifGPSDateTime(x); ok {
+		offset := t.Sub(utc).Round(15 * time.Minute)
+		if -14*time.Hour <= offset && offset <= 14*time.Hour {
+			return withLocation(t, time.FixedZone("", int(offset/time.Second))), nil
+		}
+	}
+
+	// Otherwise, interpret the timestamp in the provided location.
+	return withLocation(t, loc), nil
+}
+
+// exifGPSDateTime returns the GPS timestamp according to the EXIF metadata.
+func exifGPSDateTime(x *exif.Exif) (time.Time, bool) {
+	dateTag, err1 := x.Get(exif.GPSDateStamp)
+	timeTag, err2 := x.Get(exif.GPSTimeStamp)
+	if err1 != nil || err2 != nil || timeTag.Count != 3 {
+		return time.Time{}, false
+	}
+	date, err := dateTag.StringVal()
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("2006:01:02", strings.TrimSpace(date), time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		num, den, err := timeTag.Rat2(i)
+		if err != nil || den == 0 {
+			return time.Time{}, false
+		}
+		t = t.Add(time.Duration(float64(num) / float64(den) * float64(unit)))
+	}
+	return t, true
+}
+
+// loadEXIFSubDir loads the fields of the sub-IFD referenced by the pointer
+// field into x. It does nothing if the sub-IFD cannot be decoded.
+func loadEXIFSubDir(x *exif.Exif, ptr exif.FieldName, fieldMap map[uint16]exif.FieldName) {
+	tag, err := x.Get(ptr)
+	if err != nil {
+		return
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, 0); err != nil {
+		return
+	}
+	if d, _, err := tiff.DecodeDir(r, x.Tiff.Order); err == nil {
+		x.LoadTags(d, fieldMap, false)
+	}
+}
+
+// withLocation reinterprets the wall clock time of t as a time in loc.
+func withLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
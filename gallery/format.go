@@ -0,0 +1,147 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Decoder decodes media-specific metadata.
+type Decoder interface {
+	// DecodeMetadata loads metadata for the media file located at fp.
+	// It populates item.MediaMetadata.
+	DecodeMetadata(ctx context.Context, item *Item, fp string) error
+}
+
+// DecoderFunc is an adapter to allow the use of ordinary functions as a Decoder.
+type DecoderFunc func(ctx context.Context, item *Item, fp string) error
+
+func (f DecoderFunc) DecodeMetadata(ctx context.Context, item *Item, fp string) error {
+	return f(ctx, item, fp)
+}
+
+// PreviewGenerator generates preview images.
+type PreviewGenerator interface {
+	// GeneratePreview generates a preview image of the specified pixel height
+	// for the media file located at fp. It populates item.PreviewSrc.
+	GeneratePreview(ctx context.Context, item *Item, fp string, height int) error
+}
+
+// PreviewFunc is an adapter to allow the use of ordinary functions
+// as a PreviewGenerator.
+type PreviewFunc func(ctx context.Context, item *Item, fp string, height int) error
+
+func (f PreviewFunc) GeneratePreview(ctx context.Context, item *Item, fp string, height int) error {
+	return f(ctx, item, fp, height)
+}
+
+// Format describes how to handle a particular media file format.
+type Format struct {
+	// Name is the name of the format (e.g., "jpeg").
+	Name string
+	// Exts is the list of file extensions (including the leading dot)
+	// for the format. Extensions are matched case-insensitively.
+	Exts []string
+	// Magic is a list of signatures that identify the format by the
+	// leading bytes of the file. Each '?' in a signature matches any one byte.
+	Magic []string
+	// Rank orders the precedence of formats when multiple files share
+	// the same base name. Formats with a lower rank take precedence.
+	Rank int
+	// Video reports whether the format is a movie.
+	// A movie sharing the same base name as a still image is presented
+	// as the live portion of the image (e.g., an iPhone Live Photo).
+	Video bool
+
+	// Decoder loads media-specific metadata. It may be nil.
+	Decoder Decoder
+	// Preview generates the preview image. It must not be nil.
+	Preview PreviewGenerator
+}
+
+// match reports whether the leading bytes of a file match the format.
+func (f *Format) match(b []byte) bool {
+	for _, magic := range f.Magic {
+		if len(b) < len(magic) {
+			continue
+		}
+		matched := true
+		for i := 0; i < len(magic) && matched; i++ {
+			matched = magic[i] == '?' || magic[i] == b[i]
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   []*Format // sorted by rank
+)
+
+// RegisterFormat registers a media format for use by Generate.
+// If multiple formats claim the same extension, the one with the lowest rank
+// is used, preferring the most recently registered format among equal ranks.
+// It is usually called from an init function.
+func RegisterFormat(f Format) {
+	if f.Preview == nil {
+		panic("gallery: RegisterFormat with nil PreviewGenerator")
+	}
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats = append([]*Format{&f}, formats...)
+	sort.SliceStable(formats, func(i, j int) bool {
+		return formats[i].Rank < formats[j].Rank
+	})
+}
+
+// formatFromExt returns the registered format for the file extension,
+// or nil if the extension is not supported.
+func formatFromExt(ext string) *Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for _, f := range formats {
+		for _, e := range f.Exts {
+			if strings.EqualFold(e, ext) {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// sniffFormat returns the registered format for the media file located at fp
+// according to the leading bytes of the file. If the file matches the
+// format f already determined from the file extension (or if no registered
+// format matches), then f is returned as is.
+func sniffFormat(fp string, f *Format) *Format {
+	file, err := os.Open(fp)
+	if err != nil {
+		return f
+	}
+	defer file.Close()
+	b := make([]byte, 64)
+	n, _ := io.ReadFull(file, b)
+	b = b[:n]
+	if f != nil && (len(f.Magic) == 0 || f.match(b)) {
+		return f
+	}
+
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for _, f2 := range formats {
+		if f2.match(b) {
+			return f2
+		}
+	}
+	return f
+}
@@ -0,0 +1,945 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+// Package gallery generates a static HTML file containing previews
+// of all the images and videos in a directory.
+//
+// The previews are embedded within the HTML itself using the data URI scheme.
+// Each preview is a link to the original media file.
+// Metadata about the gallery and each item is also embedded within the HTML
+// so that a previously generated page can be used as a cache
+// when regenerating the gallery.
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHeight = 160
+	DefaultSortBy = "creation_date"
+)
+
+// Options configures gallery generation.
+//
+// For the generation parameters that are persisted in the gallery Metadata,
+// the zero value means to use the value from the previously generated
+// gallery page (if any), otherwise the default value.
+type Options struct {
+	// Height is the pixel height of each thumbnail.
+	Height int
+	// SortBy is the order to sort the gallery by.
+	// It must be either "creation_date" or "file_path".
+	SortBy string
+	// Exclude is a regular expression pattern of paths to exclude.
+	// Paths are matched as forward-slash separated paths with a leading slash,
+	// relative to the parent of the gallery directory (for a recursive gallery,
+	// the parent of the top-level directory).
+	Exclude string
+	// Timezone is the IANA time zone name (e.g., "America/Los_Angeles")
+	// used to interpret media timestamps lacking time zone information.
+	// If empty, the local time zone is used.
+	Timezone string
+	// GroupBy is the period that items are grouped into sections by.
+	// It must be either "day", "month", "year", or "none".
+	// Grouping requires that the gallery be sorted by "creation_date".
+	GroupBy string
+	// Duplicates specifies how duplicate media is handled, which is either
+	// "off", "report" to log sets of duplicates (and add them to Report),
+	// or "collapse" to also show only the largest file of each set
+	// with links to the others.
+	Duplicates string
+	// Previews specifies how previews are stored, which is either "embed"
+	// to embed previews within the gallery as data URIs, or "external" to
+	// write previews as separate files in a sibling dir+".thumbs" directory.
+	Previews string
+	// PageSize is the maximum number of items per page, where the gallery
+	// is split across dir+".html", dir+"-2.html", dir+"-3.html", and so on.
+	// If negative, the gallery is not split across multiple pages.
+	PageSize int
+	// ClockSkews are corrections for devices with an incorrect clock.
+	// The first matching clock skew is applied to each item.
+	// If nil, the clock skews from the previous gallery page are used.
+	// If non-nil and empty, no clock skews are applied.
+	ClockSkews []ClockSkew
+
+	// Recursive specifies that a separate gallery be generated for every
+	// subdirectory, rather than including all media in a single gallery.
+	Recursive bool
+
+	// CacheDir is the directory of a persistent cache of media metadata
+	// and previews that is shared across all galleries.
+	// If empty, a directory within os.UserCacheDir is used.
+	// If "off", the persistent cache is disabled.
+	CacheDir string
+	// Salvage specifies that a previously generated gallery that is corrupt
+	// be parsed as much as possible (see SalvagePage), rather than failing.
+	Salvage bool
+	// NoWait specifies that ErrLocked be returned if another process
+	// is generating the same gallery, rather than waiting for it to finish.
+	NoWait bool
+	// Procs is the number of concurrent workers.
+	// If zero or negative, runtime.NumCPU is used.
+	Procs int
+	// Timeout is the maximum time to process each media item,
+	// after which a placeholder is shown for the item and any child
+	// processes (e.g., ffmpeg) are killed. If zero, there is no timeout.
+	Timeout time.Duration
+	// Threads is the number of threads that each ffmpeg process may use.
+	// If zero, ffmpeg chooses the number of threads.
+	Threads int
+	// MaxMemory is the maximum virtual address space in bytes of each
+	// child process (on Linux only), beyond which its allocations fail.
+	// If zero, memory usage is not limited.
+	MaxMemory int64
+	// Report, if non-nil, is populated with a summary of the generation,
+	// replacing any previous contents.
+	Report *Report
+	// RetryFailed specifies that media items that previously failed
+	// to be processed be processed again, rather than reusing the failure.
+	RetryFailed bool
+	// Logger is used to report progress.
+	// If nil, slog.Default is used.
+	Logger *slog.Logger
+}
+
+// ErrLocked reports that another process is generating the same gallery.
+var ErrLocked = errors.New("gallery is locked by another process")
+
+// OptionError reports an invalid gallery generation parameter.
+type OptionError struct {
+	Name  string
+	Value interface{}
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid %q value: %v", e.Name, e.Value)
+}
+
+// Generate generates a static HTML gallery at dir+".html" containing
+// previews of all the images and videos in dir.
+// If the gallery file already exists, it is parsed and the original parameters
+// and any up-to-date preview items will be used for regeneration.
+// Generation parameters specified in opts take precedence.
+//
+// If opts.Recursive is specified, then a separate gallery is generated
+// for every subdirectory containing media, where each gallery links to the
+// galleries of its immediate subdirectories.
+func Generate(ctx context.Context, dir string, opts Options) error {
+	dir = filepath.Clean(dir)
+	if r := opts.Report; r != nil {
+		*r = Report{Start: time.Now(), Counts: make(map[string]int)}
+		defer func() { r.Seconds = time.Since(r.Start).Seconds() }()
+	}
+	if opts.Recursive {
+		_, err := generateTree(ctx, dir, opts, "", "")
+		return err
+	}
+	_, err := generatePage(ctx, dir, opts, nil, "", "")
+	return err
+}
+
+// generateTree generates a gallery for dir and every subdirectory of dir
+// that contains media. The parent is the relative URL of the parent gallery.
+// The base is the path of the parent of dir relative to the parent of the
+// top-level directory (see generatePage).
+// It returns a summary of the gallery for dir, which has no items
+// if no media was found.
+func generateTree(ctx context.Context, dir string, opts Options, parent, base string) (Folder, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Folder{}, err
+	}
+	var folders []Folder
+	for _, e := range entries {
+		if !e.IsDir() || isThumbsDir(filepath.Join(dir, e.Name())) {
+			continue
+		}
+		f, err := generateTree(ctx, filepath.Join(dir, e.Name()), opts, "../"+filepath.Base(dir)+".html", path.Join(base, filepath.Base(dir)))
+		if err != nil {
+			return Folder{}, err
+		}
+		if f.Count > 0 {
+			f.Path = path.Join(filepath.Base(dir), e.Name())
+			if f.Cover != "" && !strings.HasPrefix(f.Cover, "data:") {
+				// External previews are relative to dir.
+				f.Cover = (&url.URL{Path: filepath.Base(dir)}).String() + "/" + f.Cover
+			}
+			folders = append(folders, f)
+		}
+	}
+
+	page, err := generatePage(ctx, dir, opts, folders, parent, base)
+	if err != nil {
+		return Folder{}, err
+	}
+	var f Folder
+	for _, item := range page.Items {
+		if item.PreviewSrc != "" && f.Cover == "" {
+			f.Cover = item.PreviewSrc
+		}
+		f.Count++
+	}
+	for _, folder := range folders {
+		if f.Cover == "" {
+			f.Cover = folder.Cover
+		}
+		f.Count += folder.Count
+	}
+	return f, nil
+}
+
+// generatePage generates a gallery for dir that links to the provided folders.
+// The parent is the relative URL of the parent gallery (if any).
+// The base is the path of the parent of dir relative to the parent of the
+// top-level directory of a recursive gallery, using forward slashes,
+// such that paths are matched against opts.Exclude and path clock skews
+// the same way regardless of which gallery the media is in.
+// If opts.Recursive is specified, then only media immediately within dir
+// is included, and no gallery is written if there is no media.
+func generatePage(ctx context.Context, dir string, opts Options, folders []Folder, parent, base string) (Page, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	// Resolve paths relative to the parent directory.
+	root := filepath.Dir(dir)
+	dirName := filepath.Base(dir)
+	htmlFile := filepath.Join(root, dirName+".html")
+
+	// Prevent concurrent generation of the same gallery by other processes.
+	unlock, err := lockDir(dir, false)
+	if err == ErrLocked && !opts.NoWait {
+		logger.Info("waiting for another process to finish generating", "file", htmlFile)
+		unlock, err = lockDir(dir, true)
+	}
+	if err != nil {
+		return Page{}, err
+	}
+	defer unlock()
+
+	// parsePage parses a previously generated gallery page,
+	// salvaging whatever it can if requested.
+	parsePage := func(fp string, b []byte) (Page, error) {
+		if !opts.Salvage {
+			p, err := UnmarshalPage(b)
+			if err != nil {
+				return p, fmt.Errorf("%v: UnmarshalPage error: %v", fp, err)
+			}
+			return p, nil
+		}
+		p, errs := SalvagePage(b)
+		for _, err := range errs {
+			logger.Warn("skipping malformed content", "file", fp, "error", err)
+		}
+		return p, nil
+	}
+
+	// Parse existing .html gallery (if existing).
+	var page Page
+	var numOldPages int
+	var cachedItems map[string]Item  // keyed by path
+	var cachedHashes map[string]Item // keyed by content hash
+	var staleMetadata bool           // whether the metadata of cached items must be reloaded
+	if b, err := os.ReadFile(htmlFile); err == nil {
+		logger.Info("parsing existing gallery", "file", htmlFile)
+
+		page, err = parsePage(htmlFile, b)
+		if err != nil {
+			return page, err
+		}
+
+		// Read the items from any subsequent pages of a paginated gallery.
+		// Only links to the expected next page are followed, which prevents
+		// cycles and treating (and later removing) other files as pages.
+		numOldPages = 1
+		for next := page.Next; next != ""; {
+			if want := pageName(dirName, numOldPages); next != want {
+				logger.Warn("ignoring unexpected next page", "file", htmlFile, "next", next, "want", want)
+				break
+			}
+			b, err := os.ReadFile(filepath.Join(root, next))
+			if err != nil {
+				logger.Warn("ignoring missing page", "error", err)
+				break
+			}
+			if opts.Salvage && !isGalleryPage(b) {
+				// Salvaging never fails, so avoid treating
+				// (and later removing) an unrelated file as a page.
+				logger.Warn("ignoring next page that is not a gallery", "file", filepath.Join(root, next))
+				break
+			}
+			p, err := parsePage(next, b)
+			if err != nil {
+				return page, err
+			}
+			numOldPages++
+			page.Items = append(page.Items, p.Items...)
+			next = p.Next
+		}
+
+		// Instead of directly using the previous items,
+		// use them as a cache in case files have been deleted or modified.
+		cachedItems = make(map[string]Item)
+		cachedHashes = make(map[string]Item)
+		var items []Item
+		for _, item := range page.Items {
+			items = append(items, item)
+			items = append(items, item.collapsed...)
+		}
+		for _, item := range items {
+			item.collapsed = nil
+
+			// External previews are held in memory as data URIs.
+			if item.PreviewSrc != "" && !strings.HasPrefix(item.PreviewSrc, "data:") {
+				src, err := readExternalPreview(root, dirName, item.PreviewSrc)
+				if err != nil {
+					logger.Warn("readExternalPreview error", "path", item.Path, "error", err)
+					continue
+				}
+				item.PreviewSrc = src
+			}
+			cachedItems[item.Path] = item
+			if item.ContentHash != "" {
+				cachedHashes[item.ContentHash] = item
+			}
+		}
+		page.Items = nil
+		page.Prev, page.Next = "", ""
+
+		// If the preview height for the previous gallery differs from
+		// the specified height, then the previous entries are useless.
+		if opts.Height != 0 && opts.Height != page.Height {
+			logger.Info("discarding cached items since preview height changed", "old", page.Height, "new", opts.Height)
+			cachedItems, cachedHashes = nil, nil
+		}
+
+		// If the time zone for the previous gallery differs from the
+		// specified time zone or the metadata was loaded by an older version,
+		// then the previous timestamps may be wrong. Only the metadata
+		// is affected, so the previous previews are still reused.
+		if opts.Timezone != "" && opts.Timezone != page.Timezone {
+			logger.Info("reloading metadata since time zone changed", "old", page.Timezone, "new", opts.Timezone)
+			staleMetadata = true
+		} else if page.Version < metadataVersion {
+			logger.Info("reloading metadata since gallery is from an older version", "old", page.Version, "new", metadataVersion)
+			staleMetadata = true
+		}
+	}
+	page.Version = metadataVersion
+
+	// Handle gallery generation parameters.
+	var flags []string
+	var excludeRx *regexp.Regexp
+	if opts.Height != 0 {
+		page.Height = opts.Height
+	} else if page.Height == 0 {
+		page.Height = DefaultHeight
+	}
+	if page.Height <= 0 {
+		return page, &OptionError{"height", page.Height}
+	}
+	flags = append(flags, fmt.Sprintf("-height=%d", page.Height))
+	if opts.SortBy != "" {
+		page.SortBy = opts.SortBy
+	} else if page.SortBy == "" {
+		page.SortBy = DefaultSortBy
+	}
+	if page.SortBy != "creation_date" && page.SortBy != "file_path" {
+		return page, &OptionError{"sortby", page.SortBy}
+	}
+	flags = append(flags, fmt.Sprintf("-sortby=%s", page.SortBy))
+	if opts.Exclude != "" {
+		page.Exclude = opts.Exclude
+	}
+	if page.Exclude != "" {
+		var err error
+		excludeRx, err = regexp.Compile(page.Exclude)
+		if err != nil {
+			return page, &OptionError{"exclude", page.Exclude}
+		}
+		flags = append(flags, fmt.Sprintf("-exclude=%s", page.Exclude))
+	}
+	if opts.Timezone != "" {
+		page.Timezone = opts.Timezone
+	}
+	loc := time.Local
+	if page.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(page.Timezone)
+		if err != nil {
+			return page, &OptionError{"timezone", page.Timezone}
+		}
+		flags = append(flags, fmt.Sprintf("-timezone=%s", page.Timezone))
+	}
+	switch opts.GroupBy {
+	case "":
+	case "none":
+		page.GroupBy = ""
+	default:
+		page.GroupBy = opts.GroupBy
+	}
+	if page.GroupBy != "" {
+		if page.GroupBy != "day" && page.GroupBy != "month" && page.GroupBy != "year" {
+			return page, &OptionError{"groupby", page.GroupBy}
+		}
+		if page.SortBy != "creation_date" {
+			return page, &OptionError{"groupby", page.GroupBy + " (requires -sortby=creation_date)"}
+		}
+		flags = append(flags, fmt.Sprintf("-groupby=%s", page.GroupBy))
+	}
+	switch opts.Duplicates {
+	case "":
+	case "off":
+		page.Duplicates = ""
+	default:
+		page.Duplicates = opts.Duplicates
+	}
+	if page.Duplicates != "" {
+		if page.Duplicates != "report" && page.Duplicates != "collapse" {
+			return page, &OptionError{"duplicates", page.Duplicates}
+		}
+		flags = append(flags, fmt.Sprintf("-duplicates=%s", page.Duplicates))
+	}
+	switch opts.Previews {
+	case "":
+	case "embed":
+		page.Previews = ""
+	default:
+		page.Previews = opts.Previews
+	}
+	if page.Previews != "" {
+		if page.Previews != "external" {
+			return page, &OptionError{"previews", page.Previews}
+		}
+		flags = append(flags, fmt.Sprintf("-previews=%s", page.Previews))
+	}
+	switch {
+	case opts.PageSize > 0:
+		page.PageSize = opts.PageSize
+	case opts.PageSize < 0:
+		page.PageSize = 0
+	}
+	if page.PageSize > 0 {
+		flags = append(flags, fmt.Sprintf("-page-size=%d", page.PageSize))
+	}
+	if opts.ClockSkews != nil {
+		page.ClockSkews = opts.ClockSkews
+	}
+	for _, cs := range page.ClockSkews {
+		if (cs.Camera == "") == (cs.Path == "") {
+			return page, &OptionError{"clock-skew", cs}
+		}
+		if _, err := path.Match(cs.Path, ""); err != nil {
+			return page, &OptionError{"clock-skew", cs}
+		}
+		flags = append(flags, fmt.Sprintf("-clock-skew=%s", cs))
+	}
+	cache, err := openDiskCache(opts.CacheDir)
+	if err != nil {
+		logger.Warn("disabling disk cache", "error", err)
+	}
+	procs := opts.Procs
+	if procs <= 0 {
+		procs = runtime.NumCPU()
+	}
+	sema := make(chan struct{}, procs)
+	logger.Info("generation flags", "flags", flags)
+
+	// Collect all files in the directory.
+	allFileExts := make(map[string][]string)
+	allFileInfos := make(map[string]os.FileInfo)
+	if err := filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if opts.Recursive && fp != dir || isThumbsDir(fp) {
+				return filepath.SkipDir // subdirectories have their own gallery and previews are not media
+			}
+			return nil
+		}
+		fp, err = filepath.Rel(root, fp)
+		if err != nil {
+			return err
+		}
+		ext := path.Ext(fp)
+		if formatFromExt(ext) != nil {
+			name := strings.TrimSuffix(fp, ext)
+			allFileExts[name] = append(allFileExts[name], ext)
+			allFileInfos[fp] = fi
+		}
+		return nil
+	}); err != nil {
+		return page, fmt.Errorf("filepath.Walk error: %v", err)
+	}
+
+	// Collect up all the media items in the gallery.
+	for name, exts := range allFileExts {
+		if excludeRx != nil {
+			var kept []string
+			for _, ext := range exts {
+				if !excludeRx.MatchString("/" + path.Join(base, filepath.ToSlash(name+ext))) {
+					kept = append(kept, ext)
+				} else {
+					opts.Report.add(ItemReport{Path: filepath.Join(root, name+ext), Status: StatusExcluded})
+				}
+			}
+			if exts = kept; len(exts) == 0 {
+				continue
+			}
+		}
+		if len(exts) > 1 {
+			// Multiple extensions exist. Sort them according to format rank
+			// such that static images take precedence over animated media.
+			sort.Slice(exts, func(i, j int) bool {
+				fi := formatFromExt(exts[i])
+				fj := formatFromExt(exts[j])
+				if fi.Rank != fj.Rank {
+					return fi.Rank < fj.Rank
+				}
+				return exts[i] < exts[j]
+			})
+		}
+		fp := name + exts[0]
+		fi := allFileInfos[fp]
+		var siblings []string
+		for _, ext := range exts[1:] {
+			siblings = append(siblings, filepath.ToSlash(name+ext))
+		}
+		page.Items = append(page.Items, Item{
+			Path: filepath.ToSlash(fp),
+			MediaMetadata: MediaMetadata{
+				FileSize:   fi.Size(),
+				FileModify: fi.ModTime().UTC(),
+				Siblings:   siblings,
+			},
+			format: formatFromExt(exts[0]),
+		})
+	}
+	sort.Slice(page.Items, func(i, j int) bool {
+		return page.Items[i].Path < page.Items[j].Path
+	})
+	if opts.Recursive && len(page.Items) == 0 && len(folders) == 0 {
+		logger.Info("skipping directory since it contains no media", "dir", dir)
+		return page, nil
+	}
+	page.Folders = folders
+	page.Parent = parent
+	logger.Info("processing items", "dir", dir, "items", len(page.Items))
+
+	// Process every media item.
+	var wg sync.WaitGroup
+	var numCached, numDiskCached int64
+	reports := make([]ItemReport, len(page.Items)) // status is set once each item is fully processed
+	lastPrint := time.Now()
+	for i := range page.Items {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Print progress.
+		if now := time.Now(); now.Sub(lastPrint) > time.Second {
+			logger.Info("progress", "processed", i, "percent", math.Round(1000*float64(i)/float64(len(page.Items)))/10)
+			lastPrint = now
+		}
+
+		// Process each item.
+		i, item := i, &page.Items[i]
+		sema <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sema }()
+			start := time.Now()
+			fp := filepath.Join(root, filepath.FromSlash(item.Path))
+			finish := func(status string) {
+				// Reused items that previously failed are still failures.
+				if item.Error != "" && (status == StatusCached || status == StatusDiskCached) {
+					status = StatusFailed
+				}
+				reports[i] = ItemReport{
+					Path:         fp,
+					Status:       status,
+					Error:        item.Error,
+					Seconds:      time.Since(start).Seconds(),
+					Commands:     item.commands,
+					PreviewBytes: previewBytes(item.PreviewSrc),
+				}
+			}
+			// Always hash the file (which is cheap since large files are
+			// sampled) since an edit may preserve the size and modify time.
+			hash, err := contentHash(fp)
+			if err != nil {
+				logger.Warn("contentHash error", "path", item.Path, "error", err)
+			}
+			item.ContentHash = hash
+
+			// Check the previous gallery for the item.
+			// Items that previously timed out are always processed again,
+			// while items that previously failed are only processed again
+			// if requested.
+			// If the metadata is stale, then only the preview is reused
+			// (unless it is a placeholder, in which case the failure is reused).
+			cachedItem, ok := findCachedItem(cachedItems, cachedHashes, item)
+			ok = ok && !cachedItem.TimedOut && (cachedItem.Error == "" || !opts.RetryFailed)
+			switch {
+			case ok && (!staleMetadata || cachedItem.PreviewSrc == "" || isPlaceholderPreview(cachedItem.PreviewSrc)):
+				item.reuseMetadata(cachedItem.MediaMetadata)
+				item.PreviewSrc = cachedItem.PreviewSrc
+				atomic.AddInt64(&numCached, 1)
+				finish(StatusCached)
+
+				// Populate the disk cache in case the gallery is later removed.
+				if !staleMetadata && !cache.has(item.ContentHash) {
+					if err := cache.store(item.ContentHash, item, page.Timezone, page.Height); err != nil {
+						logger.Warn("cache.store error", "path", item.Path, "error", err)
+					}
+				}
+				return
+			case ok:
+				item.PreviewSrc = cachedItem.PreviewSrc
+				item.PerceptualHash = cachedItem.PerceptualHash
+			default:
+				// Check the disk cache for the item.
+				if entry, ok := cache.load(item.ContentHash); ok {
+					item.PreviewSrc = entry.Previews[page.Height]
+					if item.PreviewSrc != "" && entry.Version == metadataVersion && entry.Timezone == page.Timezone && (entry.Error == "" || !opts.RetryFailed) {
+						item.reuseMetadata(entry.MediaMetadata)
+						atomic.AddInt64(&numDiskCached, 1)
+						finish(StatusDiskCached)
+						return
+					}
+				}
+			}
+
+			itemCtx := ctx
+			if opts.Timeout > 0 {
+				var cancel context.CancelFunc
+				itemCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+				defer cancel()
+			}
+			item.format = sniffFormat(fp, item.format)
+			item.loc = loc
+			item.limits = commandLimits{threads: opts.Threads, maxMemory: opts.MaxMemory}
+			var errs []string
+			reason := "no preview"
+			item.logger = logger.With("path", item.Path, "stage", "metadata")
+			if err := item.loadMetadata(itemCtx, fp); err != nil {
+				item.logger.Warn("loadMetadata error", "error", err)
+				errs = append(errs, errorReason(fmt.Sprintf("loadMetadata error: %v", err)))
+			}
+			if item.PreviewSrc == "" {
+				item.logger = logger.With("path", item.Path, "stage", "preview")
+				if err := item.computePreview(itemCtx, fp, page.Height); err != nil {
+					item.logger.Warn("computePreview error", "error", err)
+					errs = append(errs, errorReason(fmt.Sprintf("computePreview error: %v", err)))
+					reason = errorReason(err.Error())
+				}
+			}
+			if ctx.Err() != nil {
+				return // the item may be incomplete, so avoid caching it
+			}
+			if itemCtx.Err() != nil {
+				logger.Warn("timed out", "path", item.Path, "timeout", opts.Timeout)
+				item.TimedOut = true
+				item.PreviewSrc = placeholderPreview(path.Base(item.Path), "timed out", page.Height)
+				finish(StatusTimedOut)
+				return // avoid caching the item so that it is processed again
+			}
+			item.Error = strings.Join(errs, "; ")
+			if err := cache.store(item.ContentHash, item, page.Timezone, page.Height); err != nil {
+				logger.Warn("cache.store error", "path", item.Path, "error", err)
+			}
+			if item.PreviewSrc == "" {
+				item.PreviewSrc = placeholderPreview(path.Base(item.Path), reason, page.Height)
+			}
+			if item.Error != "" {
+				finish(StatusFailed)
+			} else {
+				finish(StatusProcessed)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, item := range page.Items {
+		if reports[i].Status == "" {
+			reports[i] = ItemReport{Path: filepath.Join(root, filepath.FromSlash(item.Path)), Status: StatusUnfinished}
+		}
+	}
+	opts.Report.add(reports...)
+
+	// If interrupted, write a partial gallery so that the next run can reuse
+	// the finished work. Unfinished items keep what the previous gallery had
+	// for them if the file is unchanged, and are otherwise omitted.
+	if ctx.Err() != nil {
+		var numDropped int
+		items := page.Items[:0]
+		for i, item := range page.Items {
+			if reports[i].Status == StatusUnfinished {
+				cachedItem, ok := cachedItems[item.Path]
+				if !ok || staleMetadata || !sameFileInfo(&item, &cachedItem) {
+					numDropped++
+					continue
+				}
+				item.ContentHash = cachedItem.ContentHash
+				item.reuseMetadata(cachedItem.MediaMetadata)
+				item.PreviewSrc = cachedItem.PreviewSrc
+			}
+			items = append(items, item)
+		}
+		page.Items = items
+		logger.Warn("interrupted: writing partial gallery", "unfinished", numDropped)
+	} else {
+		logger.Info("items processed", "items", len(page.Items), "cached", numCached, "disk_cached", numDiskCached)
+	}
+
+	// Apply any clock skew corrections.
+	for i := range page.Items {
+		page.Items[i].skew = clockSkew(page.ClockSkews, &page.Items[i], "/"+path.Join(base, page.Items[i].Path))
+	}
+
+	// Detect any duplicate items.
+	if page.Duplicates != "" {
+		for i := range page.Items {
+			page.Items[i].loadPerceptualHash()
+		}
+		var collapsed map[int]bool
+		for _, cluster := range findDuplicates(page.Items) {
+			var paths, fps []string
+			for _, i := range cluster {
+				paths = append(paths, page.Items[i].Path)
+				fps = append(fps, filepath.Join(root, filepath.FromSlash(page.Items[i].Path)))
+			}
+			// Duplicates are the requested output, so log them even if quiet.
+			logger.Warn("duplicates", "paths", paths)
+			opts.Report.addDuplicates(fps)
+			if page.Duplicates == "collapse" {
+				if collapsed == nil {
+					collapsed = make(map[int]bool)
+				}
+				page.Items[cluster[0]].Duplicates = paths[1:]
+				for _, i := range cluster[1:] {
+					collapsed[i] = true
+					page.Items[cluster[0]].collapsed = append(page.Items[cluster[0]].collapsed, page.Items[i])
+				}
+			}
+		}
+		if len(collapsed) > 0 {
+			items := page.Items[:0]
+			for i, item := range page.Items {
+				if !collapsed[i] {
+					items = append(items, item)
+				}
+			}
+			page.Items = items
+		}
+	}
+
+	// Sort the items.
+	if page.SortBy == "creation_date" {
+		sort.Slice(page.Items, func(i, j int) bool {
+			ti := page.Items[i].DateTime()
+			tj := page.Items[j].DateTime()
+			if !ti.Equal(tj) {
+				return ti.Before(tj)
+			}
+			return page.Items[i].Path < page.Items[j].Path
+		})
+	}
+
+	// Write the gallery HTML, which may be split across multiple pages.
+	usedPreviews := make(map[string]bool)
+	if page.Previews == "external" {
+		externalize := func(item *Item) error {
+			if item.PreviewSrc == "" {
+				return nil
+			}
+			name, err := writeExternalPreview(root, dirName, item.PreviewSrc)
+			if err != nil {
+				return fmt.Errorf("writeExternalPreview error: %v", err)
+			}
+			usedPreviews[name] = true
+			item.PreviewSrc = (&url.URL{Path: name}).String()
+			return nil
+		}
+		for i := range page.Items {
+			item := &page.Items[i]
+			if err := externalize(item); err != nil {
+				return page, err
+			}
+			for j := range item.collapsed {
+				if err := externalize(&item.collapsed[j]); err != nil {
+					return page, err
+				}
+			}
+		}
+	}
+	pages := paginate(page, dirName)
+	for i, p := range pages {
+		htmlFile := filepath.Join(root, pageName(dirName, i))
+		html, err := MarshalPage(p)
+		if err != nil {
+			return page, fmt.Errorf("MarshalPage error: %v", err)
+		}
+		if b, err := os.ReadFile(htmlFile); err == nil && bytes.Equal(b, html) {
+			logger.Info("no changes made", "file", htmlFile)
+			continue // skip writing the file if identical
+		}
+		if err := writeFileAtomic(htmlFile, html, 0664); err != nil {
+			return page, fmt.Errorf("writeFileAtomic error: %v", err)
+		}
+		logger.Info("wrote gallery", "file", htmlFile)
+	}
+
+	// Remove any pages that are no longer needed.
+	for i := len(pages); i < numOldPages; i++ {
+		htmlFile := filepath.Join(root, pageName(dirName, i))
+		if err := os.Remove(htmlFile); err != nil {
+			return page, fmt.Errorf("os.Remove error: %v", err)
+		}
+		logger.Info("removed page", "file", htmlFile)
+	}
+
+	// Remove any external previews that are no longer needed.
+	if n, err := removeUnusedPreviews(root, dirName, usedPreviews); err != nil {
+		return page, fmt.Errorf("removeUnusedPreviews error: %v", err)
+	} else if n > 0 {
+		logger.Info("removed unused previews", "count", n, "dir", filepath.Join(root, thumbsDirName(dirName)))
+	}
+	return page, ctx.Err()
+}
+
+// findCachedItem returns the item from the previous gallery with the same
+// content as item, which may be at a different path if the file was renamed.
+// Previous items without a content hash are matched by path,
+// file size, and file modification time instead.
+func findCachedItem(cachedItems, cachedHashes map[string]Item, item *Item) (Item, bool) {
+	if cachedItem, ok := cachedItems[item.Path]; ok {
+		if cachedItem.ContentHash != "" {
+			if cachedItem.ContentHash == item.ContentHash {
+				return cachedItem, true
+			}
+		} else if sameFileInfo(item, &cachedItem) {
+			return cachedItem, true
+		}
+	}
+	if item.ContentHash != "" {
+		cachedItem, ok := cachedHashes[item.ContentHash]
+		return cachedItem, ok
+	}
+	return Item{}, false
+}
+
+// sameFileInfo reports whether two items have the same file size and
+// file modification time (to the precision stored in the gallery).
+func sameFileInfo(x, y *Item) bool {
+	return x.FileSize == y.FileSize &&
+		x.FileModify.Round(time.Millisecond).Equal(y.FileModify.Round(time.Millisecond))
+}
+
+// paginate splits the gallery into pages of at most page.PageSize items,
+// where each page links to the previous and next pages.
+// The folders of the gallery are only linked to from the first page.
+func paginate(page Page, dirName string) []Page {
+	if page.PageSize <= 0 || len(page.Items) <= page.PageSize {
+		return []Page{page}
+	}
+	var pages []Page
+	for i := 0; i*page.PageSize < len(page.Items); i++ {
+		p := page
+		start, end := i*page.PageSize, (i+1)*page.PageSize
+		if end >= len(page.Items) {
+			end = len(page.Items)
+		} else {
+			p.Next = pageName(dirName, i+1)
+		}
+		p.Items = page.Items[start:end]
+		if i > 0 {
+			p.Folders = nil
+			p.Prev = pageName(dirName, i-1)
+		}
+		pages = append(pages, p)
+	}
+	return pages
+}
+
+// pageName returns the file name of the i-th page (starting at zero)
+// of the gallery for the named directory.
+func pageName(dirName string, i int) string {
+	if i == 0 {
+		return dirName + ".html"
+	}
+	return fmt.Sprintf("%s-%d.html", dirName, i+1)
+}
+
+// writeFileAtomic writes data to a file such that readers observe either
+// the previous content or the new content, but never a partial write,
+// even if the system crashes. An existing file keeps its permissions,
+// while a new file is created with perm (before the umask).
+func writeFileAtomic(fp string, data []byte, perm os.FileMode) error {
+	fi, statErr := os.Stat(fp)
+
+	// Unlike os.CreateTemp, os.OpenFile applies the umask to perm.
+	dir := filepath.Dir(fp)
+	var f *os.File
+	for i := 0; f == nil; i++ {
+		name := "." + filepath.Base(fp) + "." + strconv.FormatUint(uint64(rand.Uint32()), 10) + ".tmp"
+		var err error
+		f, err = os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil && (!os.IsExist(err) || i >= 10000) {
+			return err
+		}
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if statErr == nil && fi.Mode().IsRegular() {
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	// Flush the content to disk before the rename makes it visible,
+	// otherwise a crash may leave an empty or partial file.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), fp); err != nil {
+		return err
+	}
+
+	// Flush the rename to disk. This is best-effort since directories
+	// cannot be synced on every platform (e.g., Windows).
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
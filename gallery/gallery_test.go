@@ -0,0 +1,225 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// writePNG writes a small uniform PNG image to fp.
+func writePNG(t *testing.T, fp string, c color.Color) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setNextPage replaces the link to the next page in a gallery page.
+func setNextPage(t *testing.T, fp, next string) {
+	t.Helper()
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`class="next" href="[^"]*"`)
+	if !re.Match(b) {
+		t.Fatalf("%v: missing next page link", fp)
+	}
+	b = re.ReplaceAll(b, []byte(`class="next" href="`+next+`"`))
+	if err := os.WriteFile(fp, b, 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testOptions are options for generating a gallery in a test.
+func testOptions() Options {
+	return Options{
+		PageSize: 1,
+		CacheDir: "off",
+		Procs:    1,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestGenerateNextPage(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "photos")
+	if err := os.Mkdir(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		writePNG(t, filepath.Join(dir, name), color.Gray{})
+	}
+	generate := func(opts Options) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := Generate(ctx, dir, opts); err != nil {
+			t.Fatalf("Generate error: %v", err)
+		}
+	}
+	mustExist := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+				t.Errorf("missing file: %v", err)
+			}
+		}
+	}
+	generate(testOptions())
+	mustExist("photos.html", "photos-2.html", "photos-3.html")
+
+	// A cycle in the pages must not be followed forever.
+	setNextPage(t, filepath.Join(root, "photos-2.html"), "photos-2.html")
+	generate(testOptions())
+	mustExist("photos.html", "photos-2.html", "photos-3.html")
+
+	// A link to a file that is not a page must not be removed,
+	// even if the gallery has fewer pages.
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	setNextPage(t, filepath.Join(root, "photos.html"), "notes.txt")
+	opts := testOptions()
+	opts.PageSize = 2
+	generate(opts)
+	mustExist("photos.html", "photos-2.html", "notes.txt")
+}
+
+func TestGenerateSalvageNextPage(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "photos")
+	if err := os.Mkdir(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		writePNG(t, filepath.Join(dir, name), color.Gray{})
+	}
+	generate := func(opts Options) {
+		t.Helper()
+		opts.Salvage = true
+		if err := Generate(context.Background(), dir, opts); err != nil {
+			t.Fatalf("Generate error: %v", err)
+		}
+	}
+	generate(testOptions())
+
+	// A hand-edited link to an unrelated file must not be removed.
+	plain := filepath.Join(root, "plain.txt")
+	if err := os.WriteFile(plain, []byte("plain"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	setNextPage(t, filepath.Join(root, "photos.html"), "plain.txt")
+	opts := testOptions()
+	opts.PageSize = 2
+	generate(opts)
+	if _, err := os.Stat(plain); err != nil {
+		t.Errorf("salvaged gallery removed linked file: %v", err)
+	}
+
+	// A correctly named page that is not a gallery must not be removed.
+	page2 := filepath.Join(root, "photos-2.html")
+	if err := os.WriteFile(page2, []byte("<p>not a gallery</p>"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	opts.PageSize = -1
+	generate(opts)
+	if b, err := os.ReadFile(page2); err != nil || string(b) != "<p>not a gallery</p>" {
+		t.Errorf("salvaged gallery modified unrelated page: %q, %v", b, err)
+	}
+}
+
+func TestGenerateEditPreservingModTime(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "photos")
+	if err := os.Mkdir(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	// Pad the images to the same size, which is ignored after the IEND chunk.
+	fp := filepath.Join(dir, "a.png")
+	writePaddedPNG := func(c color.Color) {
+		writePNG(t, fp, c)
+		if err := os.Truncate(fp, 1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePaddedPNG(color.Black)
+	fi, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview := func() string {
+		t.Helper()
+		if err := Generate(context.Background(), dir, testOptions()); err != nil {
+			t.Fatalf("Generate error: %v", err)
+		}
+		b, err := os.ReadFile(filepath.Join(root, "photos.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := UnmarshalPage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Items) != 1 {
+			t.Fatalf("got %d items, want 1", len(p.Items))
+		}
+		return p.Items[0].PreviewSrc
+	}
+	black := preview()
+
+	// Edit the file such that the size and modify time are unchanged.
+	writePaddedPNG(color.White)
+	if err := os.Chtimes(fp, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if white := preview(); white == black {
+		t.Errorf("preview was not regenerated after an edit that preserved the modify time")
+	}
+}
+
+func TestGenerateDuplicatesReport(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "photos")
+	if err := os.Mkdir(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	writePNG(t, filepath.Join(dir, "a.png"), color.Gray{})
+	writePNG(t, filepath.Join(dir, "b.png"), color.Gray{})
+	writePNG(t, filepath.Join(dir, "c.png"), color.White)
+
+	opts := testOptions()
+	opts.Duplicates = "report"
+	opts.Report = new(Report)
+	if err := Generate(context.Background(), dir, opts); err != nil {
+		t.Fatalf("Generate error: %v", err)
+	}
+	want := [][]string{{filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")}}
+	if !reflect.DeepEqual(opts.Report.Duplicates, want) {
+		t.Errorf("Report.Duplicates = %q, want %q", opts.Report.Duplicates, want)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package gallery
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "index.html")
+	mode := func() os.FileMode {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	// New files are subject to the umask.
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	if err := writeFileAtomic(fp, []byte("hello"), 0666); err != nil {
+		t.Fatalf("writeFileAtomic error: %v", err)
+	}
+	if got := mode(); got != 0644 {
+		t.Errorf("new file mode = %v, want %v", got, os.FileMode(0644))
+	}
+
+	// Existing files keep their mode.
+	if err := os.Chmod(fp, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(fp, []byte("goodbye"), 0666); err != nil {
+		t.Fatalf("writeFileAtomic error: %v", err)
+	}
+	if got := mode(); got != 0600 {
+		t.Errorf("existing file mode = %v, want %v", got, os.FileMode(0600))
+	}
+	if b, err := os.ReadFile(fp); err != nil || string(b) != "goodbye" {
+		t.Errorf("ReadFile = %q, %v; want %q", b, err, "goodbye")
+	}
+
+	// No temporary files are left behind.
+	if fis, err := os.ReadDir(dir); err != nil || len(fis) != 1 {
+		t.Errorf("ReadDir = %d entries, %v; want 1 entry", len(fis), err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// hashSampleSize is the size of each sample of a partially hashed file.
+const hashSampleSize = 64 << 10
+
+// contentHash returns a hex-encoded SHA-256 hash of the content of a file.
+// To avoid reading large movies in their entirety, files larger than
+// four samples are partially hashed from samples at the start, middle,
+// and end of the file together with the file size.
+func contentHash(fp string) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := fi.Size()
+
+	h := sha256.New()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(size))
+	h.Write(b[:])
+	if size <= 4*hashSampleSize {
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	} else {
+		for _, off := range []int64{0, size/2 - hashSampleSize/2, size - hashSampleSize} {
+			if _, err := io.Copy(h, io.NewSectionReader(f, off, hashSampleSize)); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,389 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func init() {
+	RegisterFormat(Format{
+		Name: "heif",
+		Exts: []string{".heic", ".heif"},
+		Magic: []string{
+			"????ftypheic", "????ftypheix", "????ftyphevc", "????ftyphevx",
+			"????ftypheim", "????ftypheis", "????ftypmif1", "????ftypmsf1",
+		},
+		Rank:    15,
+		Decoder: DecoderFunc(loadHEIFMetadata),
+		Preview: PreviewFunc(computeHEIFPreview),
+	})
+}
+
+// loadHEIFMetadata loads media-specific metadata from the EXIF item
+// stored within a HEIF container.
+// It populates item.MediaCreate and item.orientImage.
+func loadHEIFMetadata(ctx context.Context, item *Item, fp string) error {
+	x, err := decodeHEIFEXIF(fp)
+	if err != nil || x == nil {
+		return err
+	}
+	return item.loadEXIF(x)
+}
+
+// computeHEIFPreview generates a preview image for a HEIF image.
+// It populates item.PreviewSrc.
+//
+// If the EXIF thumbnail is large enough, it is used directly.
+// Otherwise, the primary image is decoded using ffmpeg.
+func computeHEIFPreview(ctx context.Context, item *Item, fp string, height int) error {
+	// Use the EXIF thumbnail if it is large enough.
+	var thumb image.Image
+	if x, _ := decodeHEIFEXIF(fp); x != nil {
+		if b, err := x.JpegThumbnail(); err == nil {
+			if img, err := jpeg.Decode(bytes.NewReader(b)); err == nil {
+				if item.orientImage != nil {
+					img = item.orientImage(img)
+				}
+				thumb = img
+			}
+		}
+	}
+	if thumb != nil && thumb.Bounds().Dy() >= height {
+		return item.encodePreview(thumb, height)
+	}
+
+	tmp, err := os.MkdirTemp("", "generate-gallery")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// Decode the primary image using ffmpeg.
+	// Auto-rotation is disabled since the EXIF orientation is applied instead.
+	if out, err := item.combinedOutput(ctx, "ffmpeg", "-noautorotate", "-i", fp, "-frames:v", "1", filepath.Join(tmp, "frame.png")); err != nil {
+		if thumb != nil {
+			return item.encodePreview(thumb, height) // better than nothing
+		}
+		return fmt.Errorf("ffmpeg decode error: %v\n%v", err, indent(string(out)))
+	}
+	b, err := os.ReadFile(filepath.Join(tmp, "frame.png"))
+	if err != nil {
+		return err
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	// Versions of ffmpeg prior to 7.1 cannot compose the tiles of a grid image
+	// (as produced by iPhones) and only decode a single tile.
+	if w, h, err := decodeHEIFSize(fp); err == nil && (img.Bounds().Dx() != w || img.Bounds().Dy() != h) {
+		logger := item.logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("decoded HEIF image is not the full size (tiled images require ffmpeg 7.1 or later)",
+			"decoded", fmt.Sprintf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy()), "expected", fmt.Sprintf("%dx%d", w, h))
+	}
+	if item.orientImage != nil {
+		img = item.orientImage(img)
+	}
+	return item.encodePreview(img, height)
+}
+
+// decodeHEIFSize returns the pixel dimensions of the primary image
+// within a HEIF file.
+func decodeHEIFSize(fp string) (width, height int, err error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return heifPrimarySize(f, fi.Size())
+}
+
+// decodeHEIFEXIF decodes the EXIF metadata within a HEIF file.
+// It returns a nil *exif.Exif if there is no EXIF metadata.
+func decodeHEIFEXIF(fp string) (*exif.Exif, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b, err := heifEXIF(f, fi.Size())
+	if b == nil {
+		return nil, err
+	}
+	return exif.Decode(bytes.NewReader(b))
+}
+
+// heifMetaBoxes returns the boxes within the "meta" box of a HEIF file.
+func heifMetaBoxes(r io.ReaderAt, size int64) ([]bmffBox, error) {
+	boxes, err := readBoxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := findBox(boxes, "meta")
+	if !ok || meta.size < 4 {
+		return nil, errors.New("missing meta box")
+	}
+	return readBoxes(r, meta.offset+4, meta.size-4) // skip version and flags
+}
+
+// heifPrimarySize returns the pixel dimensions of the primary image
+// according to its "ispe" property. For a grid image, this is the size
+// of the entire image rather than of the individual tiles.
+func heifPrimarySize(r io.ReaderAt, size int64) (width, height int, err error) {
+	boxes, err := heifMetaBoxes(r, size)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Find the item ID of the primary image.
+	pitm, ok := findBox(boxes, "pitm")
+	if !ok {
+		return 0, 0, errors.New("missing pitm box")
+	}
+	b, err := readBoxData(r, pitm)
+	if err != nil {
+		return 0, 0, err
+	}
+	br := &bmffReader{b: b}
+	var primaryID uint32
+	if version, _ := br.fullBoxHeader(); version == 0 {
+		primaryID = uint32(br.uint16())
+	} else {
+		primaryID = br.uint32()
+	}
+	if br.err != nil {
+		return 0, 0, br.err
+	}
+
+	// Find the properties associated with the primary image.
+	iprp, ok := findBox(boxes, "iprp")
+	if !ok {
+		return 0, 0, errors.New("missing iprp box")
+	}
+	iprps, err := readBoxes(r, iprp.offset, iprp.size)
+	if err != nil {
+		return 0, 0, err
+	}
+	ipco, ok1 := findBox(iprps, "ipco")
+	ipma, ok2 := findBox(iprps, "ipma")
+	if !ok1 || !ok2 {
+		return 0, 0, errors.New("missing ipco or ipma box")
+	}
+	props, err := readBoxes(r, ipco.offset, ipco.size)
+	if err != nil {
+		return 0, 0, err
+	}
+	if b, err = readBoxData(r, ipma); err != nil {
+		return 0, 0, err
+	}
+	br = &bmffReader{b: b}
+	version, flags := br.fullBoxHeader()
+	entryCount := br.uint32()
+	for i := uint32(0); i < entryCount && br.err == nil; i++ {
+		var id uint32
+		if version < 1 {
+			id = uint32(br.uint16())
+		} else {
+			id = br.uint32()
+		}
+		associationCount := br.uint8()
+		for j := uint8(0); j < associationCount && br.err == nil; j++ {
+			var index int // 1-based index into the ipco box
+			if flags&1 != 0 {
+				index = int(br.uint16() & 0x7fff)
+			} else {
+				index = int(br.uint8() & 0x7f)
+			}
+			if id != primaryID || index < 1 || index > len(props) || props[index-1].typ != "ispe" {
+				continue
+			}
+			b, err := readBoxData(r, props[index-1])
+			if err != nil {
+				return 0, 0, err
+			}
+			br := &bmffReader{b: b}
+			br.fullBoxHeader()
+			width, height := br.uint32(), br.uint32()
+			if br.err != nil {
+				return 0, 0, br.err
+			}
+			return int(width), int(height), nil
+		}
+	}
+	if br.err != nil {
+		return 0, 0, br.err
+	}
+	return 0, 0, errors.New("missing ispe property for primary item")
+}
+
+// heifEXIF returns the TIFF-encoded EXIF data stored as an item
+// within a HEIF file (ISO/IEC 23008-12).
+// It returns nil if there is no EXIF item.
+func heifEXIF(r io.ReaderAt, size int64) ([]byte, error) {
+	boxes, err := heifMetaBoxes(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the item ID of the EXIF item.
+	iinf, ok := findBox(boxes, "iinf")
+	if !ok {
+		return nil, errors.New("missing iinf box")
+	}
+	b, err := readBoxData(r, iinf)
+	if err != nil {
+		return nil, err
+	}
+	br := &bmffReader{b: b}
+	if version, _ := br.fullBoxHeader(); version == 0 {
+		br.uint16() // entry_count
+	} else {
+		br.uint32() // entry_count
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	infes, err := readBoxes(bytes.NewReader(b), int64(len(b)-len(br.b)), int64(len(br.b)))
+	if err != nil {
+		return nil, err
+	}
+	var exifID uint32
+	var foundID bool
+	for _, infe := range infes {
+		if infe.typ != "infe" {
+			continue
+		}
+		br := &bmffReader{b: b[infe.offset:][:infe.size]}
+		version, _ := br.fullBoxHeader()
+		if version < 2 {
+			continue
+		}
+		var id uint32
+		if version == 2 {
+			id = uint32(br.uint16())
+		} else {
+			id = br.uint32()
+		}
+		br.uint16() // item_protection_index
+		if itemType := string(br.next(4)); br.err == nil && itemType == "Exif" {
+			exifID, foundID = id, true
+			break
+		}
+	}
+	if !foundID {
+		return nil, nil
+	}
+
+	// Locate and read the EXIF item data.
+	iloc, ok := findBox(boxes, "iloc")
+	if !ok {
+		return nil, errors.New("missing iloc box")
+	}
+	if b, err = readBoxData(r, iloc); err != nil {
+		return nil, err
+	}
+	br = &bmffReader{b: b}
+	version, _ := br.fullBoxHeader()
+	sizes := br.uint16()
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes >> 8 & 0xf)
+	baseOffsetSize := int(sizes >> 4 & 0xf)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+	var itemCount uint32
+	if version < 2 {
+		itemCount = uint32(br.uint16())
+	} else {
+		itemCount = br.uint32()
+	}
+	for i := uint32(0); i < itemCount && br.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(br.uint16())
+		} else {
+			id = br.uint32()
+		}
+		var constructionMethod uint16
+		if version == 1 || version == 2 {
+			constructionMethod = br.uint16() & 0xf
+		}
+		br.uint16() // data_reference_index
+		baseOffset := br.uintN(baseOffsetSize)
+		extentCount := br.uint16()
+		var data []byte
+		for j := uint16(0); j < extentCount && br.err == nil; j++ {
+			br.uintN(indexSize) // extent_index
+			extentOffset := br.uintN(offsetSize)
+			extentLength := br.uintN(lengthSize)
+			if id != exifID {
+				continue
+			}
+			if constructionMethod != 0 {
+				return nil, errors.New("unsupported iloc construction method")
+			}
+			off := baseOffset + extentOffset
+			if off < baseOffset || off > uint64(size) {
+				return nil, errors.New("EXIF item out of range")
+			}
+			if extentLength == 0 {
+				extentLength = uint64(size) - off // extent spans the rest of the file
+			}
+			if extentLength > 64<<20 {
+				return nil, errors.New("EXIF item too large")
+			}
+			extent := make([]byte, extentLength)
+			if _, err := r.ReadAt(extent, int64(off)); err != nil {
+				return nil, err
+			}
+			data = append(data, extent...)
+		}
+		if id != exifID || br.err != nil {
+			continue
+		}
+
+		// The EXIF item is prefixed by the offset to the TIFF header.
+		if len(data) < 4 {
+			return nil, errors.New("truncated EXIF item")
+		}
+		skip := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		if uint64(skip) > uint64(len(data)) {
+			return nil, errors.New("invalid EXIF header offset")
+		}
+		return data[skip:], nil
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return nil, errors.New("missing EXIF item location")
+}
@@ -0,0 +1,381 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"testing"
+)
+
+// heifFile returns a HEIF file consisting of an "ftyp" box, a "meta" box
+// with the provided children, and an "mdat" box with the provided data.
+// The meta function is called with the file offset of the data.
+func heifFile(meta func(dataOffset uint64) [][]byte, data []byte) []byte {
+	build := func(off uint64) []byte {
+		return concat(
+			box("ftyp", []byte("heic"), be32(0)),
+			fullBox("meta", 0, 0, meta(off)...),
+			box("mdat", data),
+		)
+	}
+	b := build(0)
+	return build(uint64(len(b) - len(data)))
+}
+
+func iinf(infes ...[]byte) []byte {
+	return fullBox("iinf", 0, 0, be16(uint16(len(infes))), concat(infes...))
+}
+
+func infe(version uint8, id uint32, itemType string) []byte {
+	switch {
+	case version < 2:
+		return fullBox("infe", version, 0, be16(uint16(id)), be16(0), []byte("name\x00"))
+	case version == 2:
+		return fullBox("infe", version, 0, be16(uint16(id)), be16(0), []byte(itemType), []byte("\x00"))
+	default:
+		return fullBox("infe", version, 0, be32(id), be16(0), []byte(itemType), []byte("\x00"))
+	}
+}
+
+type ilocItem struct {
+	id      uint32
+	method  uint16
+	base    uint64
+	extents [][2]uint64 // offset and length pairs
+}
+
+// iloc returns an "iloc" box, where the index size is 4 for versions 1 and 2.
+func iloc(version uint8, offsetSize, lengthSize, baseSize int, items ...ilocItem) []byte {
+	indexSize := 0
+	if version > 0 {
+		indexSize = 4
+	}
+	var b []byte
+	b = append(b, be16(uint16(offsetSize<<12|lengthSize<<8|baseSize<<4|indexSize))...)
+	if version < 2 {
+		b = append(b, be16(uint16(len(items)))...)
+	} else {
+		b = append(b, be32(uint32(len(items)))...)
+	}
+	for _, item := range items {
+		if version < 2 {
+			b = append(b, be16(uint16(item.id))...)
+		} else {
+			b = append(b, be32(item.id)...)
+		}
+		if version > 0 {
+			b = append(b, be16(item.method)...)
+		}
+		b = append(b, be16(0)...) // data_reference_index
+		b = append(b, beN(baseSize, item.base)...)
+		b = append(b, be16(uint16(len(item.extents)))...)
+		for _, e := range item.extents {
+			b = append(b, beN(indexSize, 0)...)
+			b = append(b, beN(offsetSize, e[0])...)
+			b = append(b, beN(lengthSize, e[1])...)
+		}
+	}
+	return fullBox("iloc", version, 0, b)
+}
+
+func beN(n int, v uint64) []byte {
+	switch n {
+	case 0:
+		return nil
+	case 4:
+		return be32(uint32(v))
+	case 8:
+		return be64(v)
+	default:
+		return make([]byte, n)
+	}
+}
+
+func TestHEIFEXIF(t *testing.T) {
+	const tiffData = "MM\x00*TIFF"
+	exifItem := concat(be32(0), []byte(tiffData))
+	n := uint64(len(exifItem))
+	infes := iinf(infe(2, 1, "hvc1"), infe(2, 2, "Exif"))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		meta    func(off uint64) [][]byte
+		want    string
+		wantErr bool
+	}{{
+		name: "V0",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0,
+				ilocItem{id: 1, extents: [][2]uint64{{0, 1}}},
+				ilocItem{id: 2, extents: [][2]uint64{{off, n}}})}
+		},
+		want: tiffData,
+	}, {
+		name: "V1BaseOffset",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(1, 4, 4, 4,
+				ilocItem{id: 2, base: off - 4, extents: [][2]uint64{{4, n}}})}
+		},
+		want: tiffData,
+	}, {
+		name: "V2LargeIDs",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{iinf(infe(3, 0x10001, "hvc1"), infe(3, 0x10002, "Exif")), iloc(2, 8, 8, 0,
+				ilocItem{id: 0x10001},
+				ilocItem{id: 0x10002, extents: [][2]uint64{{off, n}}})}
+		},
+		want: tiffData,
+	}, {
+		name: "MultipleExtents",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0,
+				ilocItem{id: 2, extents: [][2]uint64{{off, 5}, {off + 5, n - 5}}})}
+		},
+		want: tiffData,
+	}, {
+		name: "ZeroLengthExtent",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, 0}}})}
+		},
+		want: tiffData,
+	}, {
+		name: "HeaderOffset",
+		data: concat(be32(6), []byte("Exif\x00\x00"), []byte(tiffData)),
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, n + 6}}})}
+		},
+		want: tiffData,
+	}, {
+		name: "NoEXIFItem",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{iinf(infe(2, 1, "hvc1")), iloc(0, 4, 4, 0)}
+		},
+	}, {
+		name: "LegacyInfeVersions",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{iinf(infe(0, 1, ""), infe(1, 2, "")), iloc(0, 4, 4, 0)}
+		},
+	}, {
+		name: "MissingEXIFLocation",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 1, extents: [][2]uint64{{off, n}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "MissingIloc",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes}
+		},
+		wantErr: true,
+	}, {
+		name: "MissingIinf",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, n}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "ConstructionMethod",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(1, 4, 4, 0, ilocItem{id: 2, method: 1, extents: [][2]uint64{{0, n}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "OversizedExtent",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, n + 100}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "HugeExtent",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, 1 << 31}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "OffsetOutOfRange",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(2, 8, 8, 8, ilocItem{id: 2, base: 1 << 63, extents: [][2]uint64{{1 << 63, 0}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "InvalidIntegerSize",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 2, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, n}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "TruncatedIloc",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			b := iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, n}}})
+			b = b[:len(b)-4]
+			copy(b, be32(uint32(len(b))))
+			return [][]byte{infes, b}
+		},
+		wantErr: true,
+	}, {
+		name: "TruncatedEXIFItem",
+		data: exifItem,
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, 2}}})}
+		},
+		wantErr: true,
+	}, {
+		name: "InvalidHeaderOffset",
+		data: concat(be32(100), []byte(tiffData)),
+		meta: func(off uint64) [][]byte {
+			return [][]byte{infes, iloc(0, 4, 4, 0, ilocItem{id: 2, extents: [][2]uint64{{off, n}}})}
+		},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := heifFile(tt.meta, tt.data)
+			got, err := heifEXIF(bytes.NewReader(b), int64(len(b)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("heifEXIF error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("heifEXIF = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("MissingMeta", func(t *testing.T) {
+		b := box("ftyp", []byte("heic"), be32(0))
+		if _, err := heifEXIF(bytes.NewReader(b), int64(len(b))); err == nil {
+			t.Errorf("heifEXIF succeeded, want error")
+		}
+	})
+
+	// Every truncation of a valid file must fail gracefully.
+	t.Run("Truncated", func(t *testing.T) {
+		b := heifFile(tests[0].meta, tests[0].data)
+		for i := 0; i < len(b); i++ {
+			heifEXIF(bytes.NewReader(b[:i]), int64(i))
+		}
+	})
+}
+
+func TestHEIFPrimarySize(t *testing.T) {
+	ispe := func(w, h uint32) []byte { return fullBox("ispe", 0, 0, be32(w), be32(h)) }
+	iprp := func(props [][]byte, ipma []byte) []byte {
+		return box("iprp", box("ipco", props...), ipma)
+	}
+	tests := []struct {
+		name       string
+		meta       [][]byte
+		wantWidth  int
+		wantHeight int
+		wantErr    bool
+	}{{
+		name: "V0",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+			iprp([][]byte{box("hvcC"), ispe(4032, 3024)},
+				fullBox("ipma", 0, 0, be32(1), be16(1), []byte{2, 0x81, 0x02})),
+		},
+		wantWidth: 4032, wantHeight: 3024,
+	}, {
+		name: "V1LargeIndexes",
+		meta: [][]byte{
+			fullBox("pitm", 1, 0, be32(0x10001)),
+			iprp([][]byte{box("hvcC"), ispe(4032, 3024)},
+				fullBox("ipma", 1, 1, be32(1), be32(0x10001), []byte{2}, be16(0x8001), be16(0x0002))),
+		},
+		wantWidth: 4032, wantHeight: 3024,
+	}, {
+		name: "GridWithTiles",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+			iprp([][]byte{box("hvcC"), ispe(512, 512), ispe(4032, 3024)},
+				fullBox("ipma", 0, 0, be32(2),
+					be16(2), []byte{2, 0x81, 0x02},
+					be16(1), []byte{1, 0x03})),
+		},
+		wantWidth: 4032, wantHeight: 3024,
+	}, {
+		name: "IndexOutOfRange",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+			iprp([][]byte{ispe(4032, 3024)},
+				fullBox("ipma", 0, 0, be32(1), be16(1), []byte{2, 0x00, 0x05})),
+		},
+		wantErr: true,
+	}, {
+		name: "MissingISPE",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+			iprp([][]byte{box("hvcC")},
+				fullBox("ipma", 0, 0, be32(1), be16(1), []byte{1, 0x81})),
+		},
+		wantErr: true,
+	}, {
+		name: "TruncatedISPE",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+			iprp([][]byte{fullBox("ispe", 0, 0, be32(4032))},
+				fullBox("ipma", 0, 0, be32(1), be16(1), []byte{1, 0x01})),
+		},
+		wantErr: true,
+	}, {
+		name: "TruncatedIpma",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+			iprp([][]byte{ispe(4032, 3024)},
+				fullBox("ipma", 0, 0, be32(2), be16(2), []byte{1, 0x01})),
+		},
+		wantErr: true,
+	}, {
+		name: "MissingPitm",
+		meta: [][]byte{
+			iprp([][]byte{ispe(4032, 3024)},
+				fullBox("ipma", 0, 0, be32(1), be16(1), []byte{1, 0x01})),
+		},
+		wantErr: true,
+	}, {
+		name: "MissingIprp",
+		meta: [][]byte{
+			fullBox("pitm", 0, 0, be16(1)),
+		},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := heifFile(func(uint64) [][]byte { return tt.meta }, nil)
+			w, h, err := heifPrimarySize(bytes.NewReader(b), int64(len(b)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("heifPrimarySize error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("heifPrimarySize = %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+
+	// Every truncation of a valid file must fail gracefully.
+	t.Run("Truncated", func(t *testing.T) {
+		b := heifFile(func(uint64) [][]byte { return tests[0].meta }, nil)
+		for i := 0; i < len(b); i++ {
+			heifPrimarySize(bytes.NewReader(b[:i]), int64(i))
+		}
+	})
+}
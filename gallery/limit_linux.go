@@ -0,0 +1,28 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// limitCommand returns the program and arguments for running name with args
+// such that the virtual address space of the process is limited to
+// maxMemory bytes. It returns name and args unchanged if maxMemory is zero
+// or if the program cannot be found (so that running it reports why).
+// The limit is set by a shell that then executes the program,
+// so that the limit is in effect before the program starts.
+func limitCommand(name string, args []string, maxMemory int64) (string, []string) {
+	if maxMemory <= 0 {
+		return name, args
+	}
+	prog, err := exec.LookPath(name)
+	if err != nil {
+		return name, args
+	}
+	kib := strconv.FormatInt((maxMemory+1023)>>10, 10)
+	return "sh", append([]string{"-c", `ulimit -v "$1" && shift && exec "$@"`, "sh", kib, prog}, args...)
+}
@@ -0,0 +1,14 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build !linux
+// +build !linux
+
+package gallery
+
+// limitCommand returns name and args unchanged since
+// per-process memory limits are not supported.
+func limitCommand(name string, args []string, maxMemory int64) (string, []string) {
+	return name, args
+}
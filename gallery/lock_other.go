@@ -0,0 +1,13 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package gallery
+
+// lockDir is a no-op since advisory locks are not supported.
+func lockDir(dir string, wait bool) (unlock func(), err error) {
+	return func() {}, nil
+}
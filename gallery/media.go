@@ -0,0 +1,462 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func init() {
+	RegisterFormat(Format{
+		Name:    "jpeg",
+		Exts:    []string{".jpg", ".jpeg"},
+		Magic:   []string{"\xff\xd8\xff"},
+		Rank:    10,
+		Decoder: DecoderFunc(loadEXIFMetadata),
+		Preview: PreviewFunc(computeImagePreview),
+	})
+	RegisterFormat(Format{
+		Name:    "png",
+		Exts:    []string{".png"},
+		Magic:   []string{"\x89PNG\r\n\x1a\n"},
+		Rank:    20,
+		Decoder: DecoderFunc(loadPNGMetadata),
+		Preview: PreviewFunc(computeImagePreview),
+	})
+	RegisterFormat(Format{
+		Name:    "gif",
+		Exts:    []string{".gif"},
+		Magic:   []string{"GIF87a", "GIF89a"},
+		Rank:    30,
+		Decoder: DecoderFunc(loadGIFMetadata),
+		Preview: PreviewFunc(computeAnimationPreview),
+	})
+	RegisterFormat(Format{
+		Name:    "webp",
+		Exts:    []string{".webp"},
+		Magic:   []string{"RIFF????WEBP"},
+		Rank:    40,
+		Decoder: DecoderFunc(loadWebPMetadata),
+		Preview: PreviewFunc(computeAnimationPreview),
+	})
+	RegisterFormat(Format{
+		Name:    "webm",
+		Exts:    []string{".webm"},
+		Magic:   []string{"\x1a\x45\xdf\xa3"},
+		Rank:    50,
+		Video:   true,
+		Decoder: DecoderFunc(loadMovieMetadata),
+		Preview: PreviewFunc(computeMoviePreview),
+	})
+	RegisterFormat(Format{
+		Name:    "mp4",
+		Exts:    []string{".mp4"},
+		Magic:   []string{"????ftyp"},
+		Rank:    60,
+		Video:   true,
+		Decoder: DecoderFunc(loadMovieMetadata),
+		Preview: PreviewFunc(computeMoviePreview),
+	})
+	RegisterFormat(Format{
+		Name:    "quicktime",
+		Exts:    []string{".mov"},
+		Magic:   []string{"????ftypqt", "????moov", "????mdat", "????wide"},
+		Rank:    70,
+		Video:   true,
+		Decoder: DecoderFunc(loadMovieMetadata),
+		Preview: PreviewFunc(computeMoviePreview),
+	})
+}
+
+// loadMetadata loads media-specific metadata for the media file located at fp
+// using the Decoder for the item format (if any).
+func (item *Item) loadMetadata(ctx context.Context, fp string) error {
+	if item.format == nil || item.format.Decoder == nil {
+		return nil
+	}
+	return item.format.Decoder.DecodeMetadata(ctx, item, fp)
+}
+
+// computePreview generates a preview image for the media file located at fp
+// using the PreviewGenerator for the item format.
+func (item *Item) computePreview(ctx context.Context, fp string, height int) error {
+	if item.format == nil {
+		return fmt.Errorf("unsupported format")
+	}
+	return item.format.Preview.GeneratePreview(ctx, item, fp, height)
+}
+
+// loadEXIFMetadata loads media-specific metadata from EXIF.
+// It populates item.MediaCreate and item.orientImage.
+func loadEXIFMetadata(ctx context.Context, item *Item, fp string) error {
+	// Read the EXIF metadata in the image.
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	return item.loadEXIF(x)
+}
+
+// loadEXIF loads media-specific metadata from decoded EXIF metadata.
+// It populates item.MediaCreate, item.CameraMake, item.CameraModel,
+// and item.orientImage.
+func (item *Item) loadEXIF(x *exif.Exif) error {
+	// Handle EXIF creation/modify timestamps.
+	t, err := exifDateTime(x, item.location())
+	if err != nil {
+		return err
+	}
+	if !t.IsZero() {
+		item.MediaCreate = t
+	}
+
+	// Handle EXIF camera make and model.
+	if tag, err := x.Get(exif.Make); err == nil {
+		if s, err := tag.StringVal(); err == nil {
+			item.CameraMake = strings.TrimSpace(s)
+		}
+	}
+	if tag, err := x.Get(exif.Model); err == nil {
+		if s, err := tag.StringVal(); err == nil {
+			item.CameraModel = strings.TrimSpace(s)
+		}
+	}
+
+	// Handle EXIF orientation data.
+	orient, err := x.Get(exif.Orientation)
+	if err != nil && !exif.IsTagNotPresentError(err) {
+		return err
+	}
+	if err == nil && orient != nil {
+		switch orient.String() {
+		case "1":
+			item.orientImage = func(img image.Image) image.Image { return img }
+		case "2":
+			item.orientImage = func(img image.Image) image.Image { return imaging.FlipH(img) }
+		case "3":
+			item.orientImage = func(img image.Image) image.Image { return imaging.Rotate180(img) }
+		case "4":
+			item.orientImage = func(img image.Image) image.Image { return imaging.Rotate180(imaging.FlipH(img)) }
+		case "5":
+			item.orientImage = func(img image.Image) image.Image { return imaging.Rotate270(imaging.FlipV(img)) }
+		case "6":
+			item.orientImage = func(img image.Image) image.Image { return imaging.Rotate270(img) }
+		case "7":
+			item.orientImage = func(img image.Image) image.Image { return imaging.Rotate90(imaging.FlipV(img)) }
+		case "8":
+			item.orientImage = func(img image.Image) image.Image { return imaging.Rotate90(img) }
+		}
+	}
+	return nil
+}
+
+// loadMovieMetadata loads movie metadata.
+// It populates item.MediaCreate and item.movie.
+//
+// MP4 and QuickTime files are parsed natively, while ffprobe is used
+// for other formats or if native parsing fails.
+func loadMovieMetadata(ctx context.Context, item *Item, fp string) error {
+	ext := filepath.Ext(fp)
+	info, infoErr := readMP4Info(fp, item.location())
+	item.movie = info
+
+	// Treat .JSON files as the ffprobe output for the movie file.
+	out, err := os.ReadFile(strings.TrimSuffix(fp, ext) + ".JSON")
+	if err != nil {
+		out, err = os.ReadFile(strings.TrimSuffix(fp, ext) + ".json")
+		if err != nil {
+			// Otherwise, use the natively parsed metadata.
+			if infoErr == nil {
+				if !info.created.IsZero() {
+					item.MediaCreate = info.created
+				}
+				return nil
+			}
+
+			// Otherwise, try to read the movie metadata using ffprobe.
+			out, err = item.output(ctx, "ffprobe", "-v", "quiet", fp, "-print_format", "json", "-show_format")
+			if err != nil {
+				return fmt.Errorf("ffprobe error: %v", err)
+			}
+		}
+	}
+
+	// Parse the ffprobe JSON output for the creation time.
+	// The Apple creation date takes precedence since it records
+	// the local time zone, while the creation time is always in UTC.
+	var v struct {
+		Format struct {
+			Tags struct {
+				CreationTime      time.Time `json:"creation_time"`
+				AppleCreationDate string    `json:"com.apple.quicktime.creationdate"`
+			} `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &v); err != nil {
+		return err
+	}
+	if t, err := time.Parse(appleCreationDateLayout, v.Format.Tags.AppleCreationDate); err == nil {
+		item.MediaCreate = t
+	} else if t := v.Format.Tags.CreationTime; !t.IsZero() {
+		item.MediaCreate = t.In(item.location())
+	}
+	return nil
+}
+
+// computeImagePreview generates a preview image for a static image.
+// It populates item.PreviewSrc.
+func computeImagePreview(ctx context.Context, item *Item, fp string, height int) error {
+	// Read and decode the image.
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	if item.orientImage != nil {
+		img = item.orientImage(img)
+	}
+	return item.encodePreview(img, height)
+}
+
+// encodePreview resizes and encodes the oriented image as the preview image.
+// It populates item.PreviewSrc and item.PerceptualHash.
+func (item *Item) encodePreview(img image.Image, height int) error {
+	// Resize the image.
+	img = resizeImage(img, height)
+	item.PerceptualHash = formatPerceptualHash(perceptualHash(img))
+
+	// Encode and write the image.
+	var bb bytes.Buffer
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		if err := jpeg.Encode(&bb, img, nil); err != nil {
+			return err
+		}
+		item.PreviewSrc = encodeDataURI("image/jpeg", bb.Bytes())
+	} else {
+		if err := png.Encode(&bb, img); err != nil {
+			return err
+		}
+		item.PreviewSrc = encodeDataURI("image/png", bb.Bytes())
+	}
+	return nil
+}
+
+// computeAnimationPreview generates an animated WebP preview
+// for an animated image. It populates item.PreviewSrc.
+func computeAnimationPreview(ctx context.Context, item *Item, fp string, height int) error {
+	tmp1, err := os.MkdirTemp("", "generate-gallery")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp1)
+	tmp2, err := os.MkdirTemp("", "generate-gallery")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp2)
+
+	// Convert the animated image into a series of frames.
+	if out, err := item.combinedOutput(ctx, "ffmpeg", "-i", fp, filepath.Join(tmp1, "frame_%08d.png")); err != nil {
+		if strings.EqualFold(filepath.Ext(fp), ".webp") {
+			// TODO: As of 2021-07-04, ffmpeg cannot decode WebP images.
+			// See https://trac.ffmpeg.org/ticket/4907.
+			return fmt.Errorf("not supported")
+		}
+		return fmt.Errorf("ffmpeg decode error: %v\n%v", err, indent(string(out)))
+	}
+
+	// Count the total number of frames.
+	var totalFrames int
+	fis, err := os.ReadDir(tmp1)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() && path.Ext(fi.Name()) == ".png" {
+			totalFrames++
+		}
+	}
+
+	// Periodically sample several of the frames.
+	var numFrames int
+	switch {
+	case totalFrames <= 1:
+		numFrames = 1
+	case totalFrames <= 16:
+		numFrames = 2
+	case totalFrames <= 256:
+		numFrames = 4
+	default:
+		numFrames = 8
+	}
+	framePeriod := totalFrames / numFrames
+
+	// Decode, resize, and format each frame.
+	var bb bytes.Buffer
+	for i, j := 0, 0; i < totalFrames; i, j = i+framePeriod, j+1 {
+		// Read and decode the frame.
+		b, err := os.ReadFile(filepath.Join(tmp1, fmt.Sprintf("frame_%08d.png", i+1)))
+		if err != nil {
+			return err
+		}
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+
+		// Resize the image.
+		img = resizeImage(img, height)
+
+		// Encode and write the frame.
+		bb.Reset()
+		if err := png.Encode(&bb, img); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tmp2, fmt.Sprintf("frame_%04d.png", j+1)), bb.Bytes(), 0664); err != nil {
+			return err
+		}
+	}
+
+	// Format the frames as an animated WebP preview.
+	out, err := item.combinedOutput(ctx, "ffmpeg", "-r", "4", "-i", filepath.Join(tmp2, "frame_%04d.png"), "-loop", "0", filepath.Join(tmp2, "preview.webp"))
+	if err != nil {
+		return fmt.Errorf("ffmpeg encode error: %v\n%v", err, indent(string(out)))
+	}
+	out, err = os.ReadFile(filepath.Join(tmp2, "preview.webp"))
+	if err != nil {
+		return err
+	}
+	item.PreviewSrc = encodeDataURI("image/webp", out)
+	return nil
+}
+
+// computeMoviePreview generates an animated WebP preview for a movie.
+// It populates item.PreviewSrc.
+func computeMoviePreview(ctx context.Context, item *Item, fp string, height int) error {
+	tmp, err := os.MkdirTemp("", "generate-gallery")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// Retrieve the video duration.
+	dur := item.movie.duration.Seconds()
+	if dur == 0 {
+		out, err := item.output(ctx, "ffprobe", "-i", fp, "-show_entries", "format=duration", "-v", "quiet", "-of", `csv=p=0`)
+		if err != nil {
+			return fmt.Errorf("ffprobe error: %v", err)
+		}
+		dur, err = strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+		if err != nil {
+			return err
+		}
+	}
+	duration := strconv.FormatFloat(dur, 'f', -1, 64)
+	scale := movieScaleFilter(item.movie, height)
+	var out []byte
+
+	// Periodically sample several of the frames.
+	if dur < 10.0 {
+		// For short videos, produce individual frames in a single pass.
+		frames := 8
+		if dur < 5.0 {
+			frames = 4
+		}
+		if out, err = item.combinedOutput(ctx, "ffmpeg", "-i", fp, "-vf", scale+",fps="+strconv.Itoa(frames)+"/"+duration, filepath.Join(tmp, "frame_%04d.jpeg")); err != nil {
+			return fmt.Errorf("ffmpeg decode error: %v\n%v", err, indent(string(out)))
+		}
+	} else {
+		// For long videos, produce individual frames by seeking.
+		for i := 1; i <= 10; i++ {
+			seek := fmt.Sprintf("%f", dur*float64(i)/float64(11))
+			if out, err = item.combinedOutput(ctx, "ffmpeg", "-ss", seek, "-i", fp, "-vf", scale, "-vframes", "1", filepath.Join(tmp, fmt.Sprintf("frame_%04d.jpeg", i))); err != nil {
+				return fmt.Errorf("ffmpeg decode error: %v\n%v", err, indent(string(out)))
+			}
+		}
+	}
+
+	// Format the frames as an animated WebP preview.
+	out, err = item.combinedOutput(ctx, "ffmpeg", "-r", "2", "-i", filepath.Join(tmp, "frame_%04d.jpeg"), "-loop", "0", filepath.Join(tmp, "preview.webp"))
+	if err != nil {
+		return fmt.Errorf("ffmpeg encode error: %v\n%v", err, indent(string(out)))
+	}
+	out, err = os.ReadFile(filepath.Join(tmp, "preview.webp"))
+	if err != nil {
+		return err
+	}
+	item.PreviewSrc = encodeDataURI("image/webp", out)
+	return nil
+}
+
+// movieScaleFilter returns the ffmpeg filter that scales movie frames
+// to the specified height. Since ffmpeg rotates frames according to the
+// rotation of the video track before scaling, the width is derived from
+// the displayed size of the video track (rounded to be even, as required
+// by some encoders). If the size is unknown, ffmpeg preserves the
+// aspect ratio of each decoded frame.
+func movieScaleFilter(m movieInfo, height int) string {
+	w, h := m.displaySize()
+	if w <= 0 || h <= 0 {
+		return "scale=-1:" + strconv.Itoa(height)
+	}
+	width := 2 * int(math.Round(float64(w)*float64(height)/float64(2*h)))
+	if width < 2 {
+		width = 2
+	}
+	return "scale=" + strconv.Itoa(width) + ":" + strconv.Itoa(height)
+}
+
+// resizeImage resizes the provided image to have the specified height.
+// If the image height is smaller than the specified height,
+// then it is extended, while keeping the image centered.
+// If the image height is larger than the specified height,
+// then the entire image is scaled down, while keeping the aspect ratio.
+func resizeImage(src image.Image, height int) image.Image {
+	dx, dy := src.Bounds().Dx(), src.Bounds().Dy()
+	switch {
+	case dy < height:
+		dst := image.NewNRGBA(image.Rect(0, 0, dx, height))
+		draw.Draw(dst, image.Rect(0, (height-dy)/2, dx, height), src, image.Pt(0, 0), draw.Over)
+		return dst
+	case dy > height:
+		return imaging.Resize(src, 0, height, imaging.CatmullRom)
+	default:
+		return src
+	}
+}
+
+func indent(in string) string {
+	return strings.TrimRight("\t"+strings.Join(strings.Split(in, "\n"), "\n\t"), "\t")
+}
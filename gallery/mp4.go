@@ -0,0 +1,228 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// movieInfo is metadata about a movie file.
+type movieInfo struct {
+	// created is the creation time of the movie.
+	// It is the zero value if unknown.
+	created time.Time
+	// duration is the duration of the movie.
+	duration time.Duration
+	// width and height are the pixel dimensions of the video track
+	// prior to any rotation.
+	width, height int
+	// rotation is the clockwise rotation of the video track in degrees,
+	// which is one of 0, 90, 180, or 270.
+	rotation int
+}
+
+// displaySize returns the dimensions of the video track as displayed
+// (i.e., after rotation), which are zero if unknown.
+func (m movieInfo) displaySize() (width, height int) {
+	if m.rotation == 90 || m.rotation == 270 {
+		return m.height, m.width
+	}
+	return m.width, m.height
+}
+
+// mp4Epoch is the epoch for timestamps in MP4 and QuickTime files.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// appleCreationDateLayout is the format of "com.apple.quicktime.creationdate".
+const appleCreationDateLayout = "2006-01-02T15:04:05-0700"
+
+// readMP4Info reads metadata from an MP4 or QuickTime file (ISO/IEC 14496-12)
+// without relying on any external programs.
+//
+// The creation time is derived from the Apple "com.apple.quicktime.creationdate"
+// metadata key if present (since it records the local time zone),
+// otherwise from the creation time in the "mvhd" box (which is in UTC),
+// converted to the provided location.
+func readMP4Info(fp string, loc *time.Location) (movieInfo, error) {
+	var info movieInfo
+	f, err := os.Open(fp)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return info, err
+	}
+	boxes, err := readBoxes(f, 0, fi.Size())
+	if err != nil {
+		return info, err
+	}
+	moov, ok := findBox(boxes, "moov")
+	if !ok {
+		return info, errors.New("missing moov box")
+	}
+	if boxes, err = readBoxes(f, moov.offset, moov.size); err != nil {
+		return info, err
+	}
+
+	// Parse the movie header.
+	mvhd, ok := findBox(boxes, "mvhd")
+	if !ok {
+		return info, errors.New("missing mvhd box")
+	}
+	b, err := readBoxData(f, mvhd)
+	if err != nil {
+		return info, err
+	}
+	br := &bmffReader{b: b}
+	var created, timescale, duration uint64
+	if version, _ := br.fullBoxHeader(); version == 1 {
+		created = br.uint64()
+		br.uint64() // modification_time
+		timescale = uint64(br.uint32())
+		duration = br.uint64()
+	} else {
+		created = uint64(br.uint32())
+		br.uint32() // modification_time
+		timescale = uint64(br.uint32())
+		duration = uint64(br.uint32())
+	}
+	if br.err != nil {
+		return info, br.err
+	}
+	if created > 0 {
+		info.created = mp4Epoch.Add(time.Duration(created) * time.Second).In(loc)
+	}
+	if timescale > 0 && duration != math.MaxUint32 && duration != math.MaxUint64 {
+		info.duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+
+	// Parse the track header of the first video track.
+	for _, trak := range boxes {
+		if trak.typ != "trak" {
+			continue
+		}
+		children, err := readBoxes(f, trak.offset, trak.size)
+		if err != nil {
+			return info, err
+		}
+		tkhd, ok := findBox(children, "tkhd")
+		if !ok {
+			continue
+		}
+		b, err := readBoxData(f, tkhd)
+		if err != nil {
+			return info, err
+		}
+		br := &bmffReader{b: b}
+		if version, _ := br.fullBoxHeader(); version == 1 {
+			br.next(8 + 8 + 4 + 4 + 8) // creation_time, modification_time, track_ID, reserved, duration
+		} else {
+			br.next(4 + 4 + 4 + 4 + 4) // creation_time, modification_time, track_ID, reserved, duration
+		}
+		br.next(8 + 2 + 2 + 2 + 2) // reserved, layer, alternate_group, volume, reserved
+		var matrix [9]int32
+		for i := range matrix {
+			matrix[i] = int32(br.uint32())
+		}
+		width, height := br.uint32()>>16, br.uint32()>>16
+		if br.err != nil || width == 0 || height == 0 {
+			continue // not a video track
+		}
+		info.width, info.height = int(width), int(height)
+		// The matrix is {a, b, u, c, d, v, x, y, w},
+		// where a rotation by θ is specified as {cos θ, sin θ, 0, -sin θ, cos θ, 0, ...}.
+		degrees := math.Atan2(float64(matrix[1]), float64(matrix[0])) * 180 / math.Pi
+		info.rotation = (int(math.Round(degrees/90))*90 + 360) % 360
+		break
+	}
+
+	// Parse the Apple creation date metadata key.
+	if meta, ok := findBox(boxes, "meta"); ok {
+		if t, ok := appleCreationDate(f, meta); ok {
+			info.created = t
+		}
+	}
+	return info, nil
+}
+
+// appleCreationDate returns the "com.apple.quicktime.creationdate" value
+// within the QuickTime "meta" box.
+func appleCreationDate(r io.ReaderAt, meta bmffBox) (time.Time, bool) {
+	// The QuickTime "meta" box is a regular box, while the ISO "meta" box
+	// is a full box. Handle both by checking for the version and flags.
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], meta.offset); err != nil {
+		return time.Time{}, false
+	}
+	if hdr == [4]byte{} {
+		meta.offset += 4
+		meta.size -= 4
+	}
+	boxes, err := readBoxes(r, meta.offset, meta.size)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// Find the index of the creation date key.
+	keys, ok1 := findBox(boxes, "keys")
+	ilst, ok2 := findBox(boxes, "ilst")
+	if !ok1 || !ok2 {
+		return time.Time{}, false
+	}
+	b, err := readBoxData(r, keys)
+	if err != nil {
+		return time.Time{}, false
+	}
+	br := &bmffReader{b: b}
+	br.fullBoxHeader()
+	var keyIndex uint32
+	for i, n := uint32(1), br.uint32(); i <= n && br.err == nil; i++ {
+		size := br.uint32()
+		if size < 8 {
+			return time.Time{}, false
+		}
+		br.next(4) // key_namespace
+		if key := string(br.next(int(size - 8))); br.err == nil && key == "com.apple.quicktime.creationdate" {
+			keyIndex = i
+			break
+		}
+	}
+	if keyIndex == 0 {
+		return time.Time{}, false
+	}
+
+	// Find the value for the creation date key.
+	items, err := readBoxes(r, ilst.offset, ilst.size)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, item := range items {
+		if item.typ != string([]byte{byte(keyIndex >> 24), byte(keyIndex >> 16), byte(keyIndex >> 8), byte(keyIndex)}) {
+			continue
+		}
+		values, err := readBoxes(r, item.offset, item.size)
+		if err != nil {
+			return time.Time{}, false
+		}
+		data, ok := findBox(values, "data")
+		if !ok {
+			return time.Time{}, false
+		}
+		b, err := readBoxData(r, data)
+		if err != nil || len(b) < 8 {
+			return time.Time{}, false
+		}
+		t, err := time.Parse(appleCreationDateLayout, strings.TrimSpace(string(b[8:]))) // skip type and locale
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,219 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mvhd(version uint8, created uint64, timescale uint32, duration uint64) []byte {
+	rest := make([]byte, 80) // rate, volume, reserved, matrix, pre_defined, next_track_ID
+	if version == 1 {
+		return fullBox("mvhd", 1, 0, be64(created), be64(created), be32(timescale), be64(duration), rest)
+	}
+	return fullBox("mvhd", 0, 0, be32(uint32(created)), be32(uint32(created)), be32(timescale), be32(uint32(duration)), rest)
+}
+
+// tkhd returns a track header box for a track with the given dimensions
+// that is rotated clockwise by the given multiple of 90 degrees.
+func tkhd(version uint8, width, height uint32, degrees int) []byte {
+	const one = 1 << 16
+	rot := map[int][2]int32{0: {one, 0}, 90: {0, one}, 180: {-one, 0}, 270: {0, -one}}[degrees]
+	cos, sin := rot[0], rot[1]
+	var matrix []byte
+	for _, v := range []int32{cos, sin, 0, -sin, cos, 0, 0, 0, 1 << 30} {
+		matrix = append(matrix, be32(uint32(v))...)
+	}
+	var times []byte
+	if version == 1 {
+		times = concat(be64(0), be64(0), be32(1), be32(0), be64(0)) // creation_time, modification_time, track_ID, reserved, duration
+	} else {
+		times = concat(be32(0), be32(0), be32(1), be32(0), be32(0))
+	}
+	return fullBox("tkhd", version, 0, times, make([]byte, 16), matrix, be32(width<<16), be32(height<<16))
+}
+
+// quickTimeKeys returns the "keys" and "ilst" boxes for the given metadata,
+// where each key is in the "mdta" namespace.
+func quickTimeKeys(kvs ...string) [][]byte {
+	var keys, ilst []byte
+	for i := 0; i < len(kvs); i += 2 {
+		keys = concat(keys, be32(uint32(8+len(kvs[i]))), []byte("mdta"), []byte(kvs[i]))
+		index := be32(uint32(i/2 + 1))
+		ilst = concat(ilst, box(string(index), box("data", be32(1), be32(0), []byte(kvs[i+1]))))
+	}
+	return [][]byte{fullBox("keys", 0, 0, be32(uint32(len(kvs)/2)), keys), box("ilst", ilst)}
+}
+
+func TestReadMP4Info(t *testing.T) {
+	ftyp := box("ftyp", []byte("qt  "), be32(0))
+	created := time.Date(2021, 7, 4, 17, 0, 0, 0, time.UTC)
+	secs := uint64(created.Sub(mp4Epoch) / time.Second)
+	hdlr := fullBox("hdlr", 0, 0, be32(0), []byte("mdta"), make([]byte, 13))
+	loc := time.FixedZone("", -4*3600)
+
+	tests := []struct {
+		name         string
+		in           []byte
+		wantCreated  time.Time
+		wantDuration time.Duration
+		wantSize     [2]int // displayed width and height
+		wantErr      bool
+	}{{
+		name:         "V0",
+		in:           concat(ftyp, box("moov", mvhd(0, secs, 600, 6000)), box("mdat")),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+	}, {
+		name:         "V1",
+		in:           concat(ftyp, box("mdat", make([]byte, 16)), box("moov", mvhd(1, secs, 1000, 2500))),
+		wantCreated:  created.In(loc),
+		wantDuration: 2500 * time.Millisecond,
+	}, {
+		name: "AppleCreationDate",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			box("meta", append([][]byte{hdlr}, quickTimeKeys("com.apple.quicktime.creationdate", "2021-07-04T10:00:00-0700")...)...))),
+		wantCreated:  time.Date(2021, 7, 4, 10, 0, 0, 0, time.FixedZone("", -7*3600)),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "AppleCreationDateISOMeta",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			fullBox("meta", 0, 0, append([][]byte{hdlr}, quickTimeKeys(
+				"com.apple.quicktime.make", "Apple",
+				"com.apple.quicktime.creationdate", "2021-07-04T10:00:00-0700",
+			)...)...))),
+		wantCreated:  time.Date(2021, 7, 4, 10, 0, 0, 0, time.FixedZone("", -7*3600)),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "InvalidAppleCreationDate",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			box("meta", append([][]byte{hdlr}, quickTimeKeys("com.apple.quicktime.creationdate", "yesterday")...)...))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "MissingAppleValue",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			box("meta", hdlr, fullBox("keys", 0, 0, be32(1), be32(8+32), []byte("mdtacom.apple.quicktime.creationdate")), box("ilst")))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "InvalidKeySize",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			box("meta", hdlr, fullBox("keys", 0, 0, be32(1), be32(4)), box("ilst")))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "TruncatedKeys",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			box("meta", hdlr, fullBox("keys", 0, 0, be32(1), be32(1000), []byte("mdta")), box("ilst")))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "RotatedVideoTrack",
+		in: concat(ftyp, box("moov", mvhd(0, secs, 600, 6000),
+			box("trak", tkhd(0, 0, 0, 0)), // audio track
+			box("trak", tkhd(0, 1920, 1080, 90)))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+		wantSize:     [2]int{1080, 1920},
+	}, {
+		name:         "UpsideDownVideoTrackV1",
+		in:           concat(ftyp, box("moov", mvhd(0, secs, 600, 6000), box("trak", tkhd(1, 1280, 720, 180)))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+		wantSize:     [2]int{1280, 720},
+	}, {
+		name:         "TrackWithoutHeader",
+		in:           concat(ftyp, box("moov", mvhd(0, secs, 600, 6000), box("trak", box("mdia")))),
+		wantCreated:  created.In(loc),
+		wantDuration: 10 * time.Second,
+	}, {
+		name: "UnknownCreationAndDuration",
+		in:   concat(ftyp, box("moov", mvhd(0, 0, 600, math.MaxUint32))),
+	}, {
+		name:        "ZeroTimescale",
+		in:          concat(ftyp, box("moov", mvhd(0, secs, 0, 6000))),
+		wantCreated: created.In(loc),
+	}, {
+		name:    "MissingMoov",
+		in:      concat(ftyp, box("mdat")),
+		wantErr: true,
+	}, {
+		name:    "MissingMvhd",
+		in:      concat(ftyp, box("moov", box("trak"))),
+		wantErr: true,
+	}, {
+		name:    "TruncatedMvhd",
+		in:      concat(ftyp, box("moov", fullBox("mvhd", 1, 0, be64(secs)))),
+		wantErr: true,
+	}, {
+		name:    "OversizedMoov",
+		in:      concat(ftyp, be32(1000), []byte("moov"), mvhd(0, secs, 600, 6000)),
+		wantErr: true,
+	}, {
+		name:    "InvalidChildBox",
+		in:      concat(ftyp, box("moov", be32(1000), []byte("mvhd"))),
+		wantErr: true,
+	}, {
+		name:    "Empty",
+		wantErr: true,
+	}}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := filepath.Join(dir, "movie.mov")
+			if err := os.WriteFile(fp, tt.in, 0664); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readMP4Info(fp, loc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readMP4Info error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.created.Equal(tt.wantCreated) || got.created.Format(time.RFC3339) != tt.wantCreated.Format(time.RFC3339) {
+				t.Errorf("readMP4Info.created = %v, want %v", got.created, tt.wantCreated)
+			}
+			if got.duration != tt.wantDuration {
+				t.Errorf("readMP4Info.duration = %v, want %v", got.duration, tt.wantDuration)
+			}
+			if w, h := got.displaySize(); [2]int{w, h} != tt.wantSize {
+				t.Errorf("readMP4Info.displaySize = %dx%d, want %dx%d", w, h, tt.wantSize[0], tt.wantSize[1])
+			}
+		})
+	}
+
+	// Every truncation of a valid file must fail gracefully.
+	t.Run("Truncated", func(t *testing.T) {
+		fp := filepath.Join(dir, "truncated.mov")
+		b := tests[3].in
+		for i := 0; i < len(b); i++ {
+			if err := os.WriteFile(fp, b[:i], 0664); err != nil {
+				t.Fatal(err)
+			}
+			readMP4Info(fp, loc)
+		}
+	})
+}
+
+func TestMovieScaleFilter(t *testing.T) {
+	tests := []struct {
+		movie movieInfo
+		want  string
+	}{
+		{movieInfo{}, "scale=-1:160"},
+		{movieInfo{width: 1920, height: 1080}, "scale=284:160"},
+		{movieInfo{width: 1920, height: 1080, rotation: 90}, "scale=90:160"},
+		{movieInfo{width: 1920, height: 1080, rotation: 180}, "scale=284:160"},
+		{movieInfo{width: 1, height: 1000}, "scale=2:160"},
+	}
+	for _, tt := range tests {
+		if got := movieScaleFilter(tt.movie, 160); got != tt.want {
+			t.Errorf("movieScaleFilter(%+v) = %q, want %q", tt.movie, got, tt.want)
+		}
+	}
+}
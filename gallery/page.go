@@ -0,0 +1,529 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"log/slog"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page is a gallery page.
+type Page struct {
+	// Metadata is metadata about the gallery.
+	Metadata
+	// Items is the list of media items in the gallery.
+	Items []Item
+	// Folders is the list of subdirectory galleries linked to by the gallery.
+	Folders []Folder
+	// Parent is the relative URL of the parent gallery (if any).
+	Parent string // e.g., "../2021.html"
+	// Prev and Next are the relative URLs of the previous and next pages
+	// of a gallery split across multiple pages (if any).
+	Prev, Next string // e.g., "2021Q1-2.html"
+}
+
+// Folder is a subdirectory gallery linked to by a gallery.
+type Folder struct {
+	// Path is the relative path of the subdirectory using forward slashes,
+	// where the gallery for the subdirectory is at Path+".html".
+	Path string // e.g., "2021/2021Q1"
+	// Cover is a preview image source for the subdirectory.
+	Cover string
+	// Count is the number of media items within the subdirectory tree.
+	Count int
+}
+
+// metadataVersion is the version of how media metadata is loaded.
+// Items from a gallery with an older version have their metadata reloaded,
+// while still reusing their previews.
+//
+//	1: MediaCreate is in the time zone where the media was captured.
+//	2: CameraMake and CameraModel are recorded (for camera clock skews).
+const metadataVersion = 2
+
+// Metadata is metadata about the gallery.
+// The exported fields are serialized as metadata in the .html file.
+type Metadata struct {
+	// Version is the metadataVersion that the media metadata was loaded with.
+	// It is zero for galleries generated before metadata was versioned.
+	Version int `json:",omitempty"`
+	// Height is the pixel height of the preview image.
+	Height int
+	// SortBy is the order to sort preview images by.
+	SortBy string
+	// Exclude is the regular expression pattern of paths to exclude.
+	Exclude string `json:",omitempty"`
+	// Timezone is the time zone for media timestamps lacking time zone
+	// information. If empty, the local time zone is used.
+	Timezone string `json:",omitempty"`
+	// ClockSkews are corrections for cameras with an incorrect clock.
+	ClockSkews []ClockSkew `json:",omitempty"`
+	// Previews is "external" if previews are stored as separate files.
+	// If empty, previews are embedded within the page as data URIs.
+	Previews string `json:",omitempty"`
+	// Duplicates is either "report" to report duplicate media or
+	// "collapse" to also show only one item for each set of duplicates.
+	// If empty, duplicates are not detected.
+	Duplicates string `json:",omitempty"`
+	// PageSize is the maximum number of items per page.
+	// If zero, the gallery is not split across multiple pages.
+	PageSize int `json:",omitempty"`
+	// GroupBy is the period that items are grouped into sections by,
+	// which is either "day", "month", or "year". If empty, items are not grouped.
+	GroupBy string `json:",omitempty"`
+}
+
+// Item is an individual thumbnail to show on the gallery page.
+type Item struct {
+	// Path is the relative file path using forward slashes.
+	Path string // e.g., "2021Q1/IMG_6189.JPG"
+	// MediaMetadata is metadata about the file and/or media.
+	MediaMetadata
+	// PreviewSrc is a preview image source for the media item.
+	// It is either a data URI or a relative URL to an external preview file.
+	PreviewSrc string // e.g., "data:image/jpeg;base64, {{.Base64EncodedData}}>"
+
+	// format is the registered format of the media file.
+	format *Format
+	// orientImage modifies an image according to orientation metadata.
+	orientImage func(image.Image) image.Image
+	// movie is metadata about a movie file.
+	movie movieInfo
+	// loc is the time zone for media timestamps lacking time zone information.
+	loc *time.Location
+	// skew is the clock skew correction to apply to MediaCreate.
+	skew time.Duration
+	// limits are the resource limits for child processes.
+	limits commandLimits
+	// commands are the child processes that were run for the item.
+	commands []CommandReport
+	// collapsed are the items listed in Duplicates, which are stored
+	// in the gallery (but not shown) so that they are not processed again.
+	collapsed []Item
+	// logger is used to report the processing of the item.
+	logger *slog.Logger
+}
+
+// MediaMetadata is metadata regarding a single media item.
+// The exported fields are serialized as metadata in the .html file.
+type MediaMetadata struct {
+	// FileSize is the fs.FileInfo.Size for the file on disk.
+	FileSize int64
+	// FileModify is the fs.FileInfo.ModTime for the file on disk.
+	FileModify time.Time
+	// MediaCreate is the creation time according to the file metadata.
+	// It is in the time zone of where the media was captured (if known).
+	MediaCreate time.Time
+	// ContentHash is a hex-encoded SHA-256 hash of the file content (sampled
+	// for large files), which is used to detect modified or renamed files.
+	ContentHash string `json:",omitempty"`
+	// PerceptualHash is a hex-encoded 64-bit difference hash of the
+	// preview image, which is used to detect near duplicate images.
+	PerceptualHash string `json:",omitempty"`
+	// CameraMake and CameraModel are the make and model of the camera
+	// that captured the media according to the file metadata.
+	CameraMake  string `json:",omitempty"`
+	CameraModel string `json:",omitempty"`
+	// Siblings are the relative file paths of other media files that share
+	// the same base name (e.g., the movie of an iPhone Live Photo),
+	// in order of format precedence.
+	Siblings []string `json:",omitempty"`
+	// Duplicates are the relative file paths of other media files that
+	// are duplicates of this item and are not shown in the gallery.
+	Duplicates []string `json:",omitempty"`
+	// TimedOut reports whether processing the media took too long,
+	// in which case the preview is a placeholder and the media is
+	// processed again by the next run.
+	TimedOut bool `json:",omitempty"`
+	// Error is the reason why loading the metadata or generating the preview
+	// for the media failed. If the preview failed, it is a placeholder.
+	Error string `json:",omitempty"`
+}
+
+// DateTime returns the media creation timestamp (corrected for any
+// clock skew) if available, otherwise it returns the file modify timestamp.
+func (item Item) DateTime() time.Time {
+	if !item.MediaCreate.IsZero() {
+		return item.MediaCreate.Add(item.skew)
+	}
+	return item.FileModify
+}
+
+// reuseMetadata sets the media metadata of item to that of another file
+// with the same content, preserving the metadata specific to the file.
+func (item *Item) reuseMetadata(md MediaMetadata) {
+	md.FileSize = item.FileSize
+	md.FileModify = item.FileModify
+	md.ContentHash = item.ContentHash
+	md.Siblings = item.Siblings
+	md.Duplicates = item.Duplicates
+	item.MediaMetadata = md
+}
+
+// location returns the time zone for media timestamps lacking
+// time zone information.
+func (item *Item) location() *time.Location {
+	if item.loc != nil {
+		return item.loc
+	}
+	return time.Local
+}
+
+// UnmarshalPage parses a gallery page previously produced by MarshalPage.
+func UnmarshalPage(b []byte) (Page, error) {
+	page, errs := unmarshalPage(b, false)
+	if len(errs) > 0 {
+		return page, errs[0]
+	}
+	return page, nil
+}
+
+// SalvagePage parses a gallery page previously produced by MarshalPage,
+// which may have been corrupted or edited by hand.
+// Malformed items are skipped, and malformed metadata is left as the zero value.
+// It returns an error for every malformed line.
+func SalvagePage(b []byte) (Page, []error) {
+	return unmarshalPage(b, true)
+}
+
+// isGalleryPage reports whether b appears to be a gallery page produced by
+// MarshalPage, even if it is otherwise corrupt.
+func isGalleryPage(b []byte) bool {
+	return bytes.Contains(b, []byte(`<html data-magic="generate-gallery"`))
+}
+
+func unmarshalPage(b []byte, salvage bool) (page Page, errs []error) {
+	var parsedHeader int
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		var err error
+		switch {
+		case strings.HasPrefix(line, "<html") && strings.HasSuffix(line, ">"):
+			parsedHeader++
+			var md Metadata
+			if md, err = unmarshalHeader(line); err == nil {
+				page.Metadata = md
+			}
+		case strings.HasPrefix(line, "<a ") && strings.HasSuffix(line, "</a>"):
+			err = page.unmarshalAnchor(line)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", i+1, err))
+			if !salvage {
+				return page, errs
+			}
+		}
+	}
+	switch {
+	case parsedHeader < 1:
+		errs = append(errs, errors.New("html tag missing"))
+	case parsedHeader > 1:
+		errs = append(errs, errors.New("html tag appeared multiple times"))
+	}
+	return page, errs
+}
+
+// unmarshalHeader parses the gallery metadata from the <html> tag.
+func unmarshalHeader(line string) (Metadata, error) {
+	var md Metadata
+	var html struct {
+		XMLName  xml.Name `xml:"html"`
+		Magic    string   `xml:"data-magic,attr"`
+		Metadata string   `xml:"data-gallery,attr"`
+	}
+	if err := xml.Unmarshal([]byte(line+"</html>"), &html); err != nil {
+		return md, err
+	}
+	if html.Magic != "generate-gallery" {
+		return md, errors.New("missing magic marker")
+	}
+	b, err := base64.StdEncoding.DecodeString(html.Metadata)
+	if err != nil {
+		return md, err
+	}
+	if err := json.Unmarshal(b, &md); err != nil {
+		return md, err
+	}
+	return md, nil
+}
+
+// unmarshalAnchor parses an <a> tag, which may be a media item or
+// a link to another gallery page.
+func (page *Page) unmarshalAnchor(line string) error {
+	var anchor struct {
+		XMLName   xml.Name `xml:"a"`
+		Class     string   `xml:"class,attr"`
+		Reference string   `xml:"href,attr"`
+		Count     int      `xml:"data-count,attr"`
+		Image     struct {
+			XMLName  xml.Name `xml:"img"`
+			Source   string   `xml:"src,attr"`
+			Metadata string   `xml:"data-media,attr"`
+		}
+	}
+	if err := xml.Unmarshal([]byte(line), &anchor); err != nil {
+		return err
+	}
+	u, err := url.Parse(anchor.Reference)
+	if err != nil {
+		return err
+	}
+	switch {
+	case anchor.Class == "parent":
+		page.Parent = u.Path
+		return nil
+	case anchor.Class == "prev":
+		page.Prev = u.Path
+		return nil
+	case anchor.Class == "next":
+		page.Next = u.Path
+		return nil
+	case anchor.Class == "folder":
+		page.Folders = append(page.Folders, Folder{
+			Path:  strings.TrimSuffix(u.Path, ".html"),
+			Cover: anchor.Image.Source,
+			Count: anchor.Count,
+		})
+		return nil
+	case anchor.Image.Metadata == "":
+		return nil // not a media item (e.g., a link to a sibling variant)
+	}
+	item := Item{Path: u.Path, PreviewSrc: anchor.Image.Source}
+	b, err := base64.StdEncoding.DecodeString(anchor.Image.Metadata)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &item.MediaMetadata); err != nil {
+		return err
+	}
+	if anchor.Class == "duplicate" {
+		// Collapsed duplicates immediately follow the item they belong to.
+		if len(page.Items) == 0 {
+			return errors.New("duplicate without a preceding item")
+		}
+		last := &page.Items[len(page.Items)-1]
+		last.collapsed = append(last.collapsed, item)
+		return nil
+	}
+	page.Items = append(page.Items, item)
+	return nil
+}
+
+// MarshalPage formats the gallery page as HTML.
+// Items without a preview are omitted.
+// Collapsed duplicates are stored within the link to each duplicate.
+func MarshalPage(page Page) ([]byte, error) {
+	var bb bytes.Buffer
+	b, err := json.Marshal(page.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	metadata := ` data-gallery="` + base64.StdEncoding.EncodeToString(b) + `"`
+	bb.WriteString("<html data-magic=\"generate-gallery\"" + metadata + ">\n")
+	bb.WriteString(pageHead)
+	bb.WriteString("<body>\n")
+	if page.Parent != "" {
+		bb.WriteString("<a class=\"parent\" href=\"" + escapeURL(page.Parent) + "\">&#8593; " + html.EscapeString(strings.TrimSuffix(path.Base(page.Parent), ".html")) + "</a>\n")
+	}
+	writePageLinks(&bb, page)
+	for _, f := range page.Folders {
+		name := html.EscapeString(path.Base(f.Path))
+		count := strconv.Itoa(f.Count)
+		units := " items"
+		if f.Count == 1 {
+			units = " item"
+		}
+		var cover string
+		if f.Cover != "" {
+			cover = "<img loading=\"lazy\" src=\"" + html.EscapeString(f.Cover) + "\"/>"
+		}
+		bb.WriteString("<a class=\"folder\" href=\"" + escapeURL(f.Path+".html") + "\" data-count=\"" + count + "\" title=\"" + name + "; " + count + units + "\">" + cover + "<span>" + name + " (" + count + ")</span></a>\n")
+	}
+	loc := time.Local
+	if page.Timezone != "" {
+		if l, err := time.LoadLocation(page.Timezone); err == nil {
+			loc = l
+		}
+	}
+	// Media timestamps are formatted in the time zone where the media
+	// was captured, while file timestamps are formatted in the
+	// time zone of the gallery.
+	displayTime := func(item Item) time.Time {
+		t := item.DateTime()
+		if item.MediaCreate.IsZero() {
+			t = t.In(loc)
+		}
+		return t
+	}
+
+	// Group the items into sections by the calendar date where the media
+	// was captured. Since items are sorted by absolute time, items captured
+	// in different time zones may not be contiguous within a section,
+	// so sections are ordered by date with items in their sorted order.
+	var sections []groupPeriod
+	sectionItems := make(map[groupPeriod][]Item)
+	for _, item := range page.Items {
+		if len(item.PreviewSrc) > 0 {
+			var g groupPeriod
+			if page.GroupBy != "" {
+				g = groupByPeriod(page.GroupBy, displayTime(item))
+			}
+			if _, ok := sectionItems[g]; !ok {
+				sections = append(sections, g)
+			}
+			sectionItems[g] = append(sectionItems[g], item)
+		}
+	}
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].id < sections[j].id
+	})
+
+	// Emit a table of contents for all the sections.
+	if page.GroupBy != "" {
+		bb.WriteString("<nav>\n")
+		for _, g := range sections {
+			bb.WriteString("<a href=\"#" + g.id + "\">" + html.EscapeString(g.label) + "</a>\n")
+		}
+		bb.WriteString("</nav>\n")
+	}
+
+	for _, g := range sections {
+		if page.GroupBy != "" {
+			bb.WriteString("<h2 id=\"" + g.id + "\">" + html.EscapeString(g.label) + "</h2>\n")
+		}
+		for _, item := range sectionItems[g] {
+			t := displayTime(item)
+			title := path.Base(item.Path) + "; " + t.Round(time.Second).Format("2006-01-02 15:04:05")
+			switch {
+			case item.TimedOut:
+				title += "; timed out"
+			case item.Error != "":
+				title += "; " + item.Error
+			}
+			title = ` title="` + html.EscapeString(title) + `"`
+			b, err := json.Marshal(item.MediaMetadata)
+			if err != nil {
+				return nil, err
+			}
+			metadata := ` data-media="` + base64.StdEncoding.EncodeToString(b) + `"`
+			var live string
+			if f := formatFromExt(path.Ext(item.Path)); f != nil && !f.Video {
+				for _, sibling := range item.Siblings {
+					if f := formatFromExt(path.Ext(sibling)); f != nil && f.Video {
+						live = ` data-live="` + escapeURL(sibling) + `"`
+						break
+					}
+				}
+			}
+			bb.WriteString("<a href=\"" + escapeURL(item.Path) + "\" target=\"_blank\"><img loading=\"lazy\" src=\"" + html.EscapeString(item.PreviewSrc) + "\"" + title + metadata + live + "/></a>\n")
+			for _, sibling := range item.Siblings {
+				label := html.EscapeString(strings.ToUpper(strings.TrimPrefix(path.Ext(sibling), ".")))
+				bb.WriteString("<a class=\"variant\" href=\"" + escapeURL(sibling) + "\" target=\"_blank\" title=\"" + html.EscapeString(path.Base(sibling)) + "\">" + label + "</a>\n")
+			}
+			for _, dup := range item.Duplicates {
+				var hidden string
+				for _, c := range item.collapsed {
+					if c.Path == dup && c.PreviewSrc != "" {
+						b, err := json.Marshal(c.MediaMetadata)
+						if err != nil {
+							return nil, err
+						}
+						hidden = "<img hidden=\"\" loading=\"lazy\" src=\"" + html.EscapeString(c.PreviewSrc) + "\" data-media=\"" + base64.StdEncoding.EncodeToString(b) + "\"/>"
+						break
+					}
+				}
+				bb.WriteString("<a class=\"duplicate\" href=\"" + escapeURL(dup) + "\" target=\"_blank\" title=\"" + html.EscapeString(dup) + "\">DUP" + hidden + "</a>\n")
+			}
+		}
+	}
+	writePageLinks(&bb, page)
+	bb.WriteString("</body>\n")
+	bb.WriteString("</html>\n")
+	return bb.Bytes(), nil
+}
+
+// writePageLinks writes the links to the previous and next pages (if any).
+func writePageLinks(bb *bytes.Buffer, page Page) {
+	if page.Prev != "" {
+		bb.WriteString("<a class=\"prev\" href=\"" + escapeURL(page.Prev) + "\">&#8592; Previous</a>\n")
+	}
+	if page.Next != "" {
+		bb.WriteString("<a class=\"next\" href=\"" + escapeURL(page.Next) + "\">Next &#8594;</a>\n")
+	}
+}
+
+// groupPeriod is a period of time that items are grouped into sections by.
+type groupPeriod struct {
+	id    string // e.g., "2021-07"
+	label string // e.g., "July 2021"
+}
+
+// groupByPeriod returns the period that t belongs to
+// when grouping by "day", "month", or "year".
+func groupByPeriod(groupBy string, t time.Time) groupPeriod {
+	switch groupBy {
+	case "day":
+		return groupPeriod{t.Format("2006-01-02"), t.Format("Monday, January 2, 2006")}
+	case "month":
+		return groupPeriod{t.Format("2006-01"), t.Format("January 2006")}
+	default:
+		return groupPeriod{t.Format("2006"), t.Format("2006")}
+	}
+}
+
+// escapeURL escapes a relative file path as an HTML-escaped URL.
+func escapeURL(p string) string {
+	return html.EscapeString((&url.URL{Path: p}).String())
+}
+
+// pageHead is the <head> element of every gallery page.
+const pageHead = `<head>
+<style>
+a.variant, a.duplicate { font: x-small sans-serif; vertical-align: top; margin-right: 4px; }
+a.duplicate { color: gray; }
+nav a { margin-right: 8px; }
+a.parent { display: block; font: medium sans-serif; margin-bottom: 8px; }
+a.folder { display: inline-block; vertical-align: top; text-align: center; font: small sans-serif; margin: 0 8px 8px 0; }
+a.folder span { display: block; }
+a.prev, a.next { display: inline-block; font: medium sans-serif; margin: 8px 16px 8px 0; }
+h2 { font: bold large sans-serif; margin: 16px 0 4px; }
+</style>
+<script>
+// Play the live portion of an image (e.g., an iPhone Live Photo) on hover.
+document.addEventListener("DOMContentLoaded", function() {
+	document.querySelectorAll("img[data-live]").forEach(function(img) {
+		var video = document.createElement("video");
+		video.src = img.dataset.live;
+		video.muted = true;
+		video.loop = true;
+		video.playsInline = true;
+		img.parentNode.addEventListener("mouseenter", function() {
+			video.height = img.height;
+			img.replaceWith(video);
+			video.play();
+		});
+		img.parentNode.addEventListener("mouseleave", function() {
+			video.pause();
+			video.replaceWith(img);
+		});
+	});
+});
+</script>
+</head>
+`
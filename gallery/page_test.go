@@ -0,0 +1,88 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshalPageGroupBy(t *testing.T) {
+	tokyo, pacific := time.FixedZone("", 9*3600), time.FixedZone("", -7*3600)
+	page := Page{
+		Metadata: Metadata{Height: 160, SortBy: "creation_date", GroupBy: "day"},
+		Items: []Item{ // sorted by absolute time, but not by local date
+			{Path: "a.jpg", PreviewSrc: "data:a", MediaMetadata: MediaMetadata{MediaCreate: time.Date(2021, 7, 2, 1, 0, 0, 0, tokyo)}},
+			{Path: "b.jpg", PreviewSrc: "data:b", MediaMetadata: MediaMetadata{MediaCreate: time.Date(2021, 7, 1, 20, 0, 0, 0, pacific)}},
+			{Path: "c.jpg", PreviewSrc: "data:c", MediaMetadata: MediaMetadata{MediaCreate: time.Date(2021, 7, 2, 14, 0, 0, 0, tokyo)}},
+		},
+	}
+	b, err := MarshalPage(page)
+	if err != nil {
+		t.Fatalf("MarshalPage error: %v", err)
+	}
+
+	// Every section must appear exactly once in date order,
+	// with items in their sorted order within each section.
+	var got []string
+	for _, m := range regexp.MustCompile(`<h2 id="([^"]*)"|<a href="([a-z]\.jpg)"`).FindAllStringSubmatch(string(b), -1) {
+		got = append(got, m[1]+m[2])
+	}
+	want := []string{"2021-07-01", "b.jpg", "2021-07-02", "a.jpg", "c.jpg"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("MarshalPage order = %v, want %v", got, want)
+	}
+
+	p, err := UnmarshalPage(b)
+	if err != nil {
+		t.Fatalf("UnmarshalPage error: %v", err)
+	}
+	if len(p.Items) != len(page.Items) {
+		t.Errorf("UnmarshalPage returned %d items, want %d", len(p.Items), len(page.Items))
+	}
+}
+
+func TestMarshalPageCollapsed(t *testing.T) {
+	page := Page{
+		Metadata: Metadata{Height: 160, Duplicates: "collapse"},
+		Items: []Item{{
+			Path:          "a.jpg",
+			PreviewSrc:    "data:a",
+			MediaMetadata: MediaMetadata{FileSize: 30, Duplicates: []string{"b.jpg", "c.jpg"}},
+			collapsed: []Item{
+				{Path: "b.jpg", PreviewSrc: "data:b", MediaMetadata: MediaMetadata{FileSize: 20}},
+				{Path: "c.jpg", MediaMetadata: MediaMetadata{FileSize: 10}}, // no preview
+			},
+		}, {
+			Path:       "d.jpg",
+			PreviewSrc: "data:d",
+		}},
+	}
+	b, err := MarshalPage(page)
+	if err != nil {
+		t.Fatalf("MarshalPage error: %v", err)
+	}
+	p, err := UnmarshalPage(b)
+	if err != nil {
+		t.Fatalf("UnmarshalPage error: %v", err)
+	}
+	var got []string
+	for _, item := range p.Items {
+		s := item.Path + ":"
+		for _, c := range item.collapsed {
+			s += " " + c.Path + "=" + c.PreviewSrc
+		}
+		got = append(got, s)
+	}
+	want := []string{"a.jpg: b.jpg=data:b", "d.jpg:"}
+	if strings.Join(got, " | ") != strings.Join(want, " | ") {
+		t.Errorf("UnmarshalPage items = %q, want %q", got, want)
+	}
+	if b2, err := MarshalPage(p); err != nil || string(b2) != string(b) {
+		t.Errorf("MarshalPage is not stable after UnmarshalPage (error: %v)", err)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+func init() {
+	// Camera RAW formats are usually accompanied by a JPEG rendition
+	// from the camera itself, which should take precedence.
+	RegisterFormat(Format{
+		Name:    "raw",
+		Exts:    []string{".dng", ".cr2", ".nef", ".arw"},
+		Magic:   []string{"II*\x00", "MM\x00*"},
+		Rank:    25,
+		Decoder: DecoderFunc(loadRawMetadata),
+		Preview: PreviewFunc(computeRawPreview),
+	})
+}
+
+// TIFF tags relevant to locating JPEG images embedded in camera RAW files.
+const (
+	tiffCompression                 = 0x0103
+	tiffStripOffsets                = 0x0111
+	tiffStripByteCounts             = 0x0117
+	tiffSubIFDs                     = 0x014a
+	tiffJPEGInterchangeFormat       = 0x0201
+	tiffJPEGInterchangeFormatLength = 0x0202
+)
+
+// TIFF tags that point to the IFDs containing EXIF metadata.
+const (
+	tiffExifIFD    = 0x8769
+	tiffGPSIFD     = 0x8825
+	tiffInteropIFD = 0xa005
+)
+
+// loadRawMetadata loads media-specific metadata from the EXIF metadata
+// of a camera RAW file, populating the same fields as loadEXIFMetadata.
+// Unlike exif.Decode, which reads the entire file into memory,
+// only IFD0 and the EXIF and GPS IFDs are read.
+func loadRawMetadata(ctx context.Context, item *Item, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	b, err := rawEXIF(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	x, err := exif.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return item.loadEXIF(x)
+}
+
+// computeRawPreview generates a preview image for a camera RAW file
+// from the JPEG images embedded within the TIFF-based container.
+// It populates item.PreviewSrc.
+func computeRawPreview(ctx context.Context, item *Item, fp string, height int) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	jpegs, err := rawEmbeddedJPEGs(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	// Use the smallest embedded JPEG that is at least as large as the preview,
+	// otherwise use the largest embedded JPEG.
+	var best *io.SectionReader
+	for _, jr := range jpegs {
+		cfg, err := jpeg.DecodeConfig(jr)
+		if err != nil {
+			continue // e.g., lossless JPEG used for the RAW data itself
+		}
+		best = jr
+		if cfg.Width >= height && cfg.Height >= height {
+			break
+		}
+	}
+	if best == nil {
+		return errors.New("no embedded JPEG preview")
+	}
+	if _, err := best.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, err := jpeg.Decode(best)
+	if err != nil {
+		return err
+	}
+	if item.orientImage != nil {
+		img = item.orientImage(img)
+	}
+	return item.encodePreview(img, height)
+}
+
+// maxRawIFDs is the maximum number of IFDs that are read from a RAW file.
+const maxRawIFDs = 64
+
+// rawEmbeddedJPEGs returns all JPEG images embedded in a TIFF-based
+// camera RAW file of the given size, sorted in order of increasing size.
+// Only the IFDs are read, rather than the entire file.
+//
+// Embedded JPEGs are found in IFD0, IFD1, and any SubIFDs either through
+// the JPEGInterchangeFormat tags (e.g., ARW and NEF thumbnails and previews)
+// or as JPEG-compressed strips (e.g., CR2 and DNG previews).
+func rawEmbeddedJPEGs(r io.ReaderAt, size int64) ([]*io.SectionReader, error) {
+	order, ifd0, err := readTIFFHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gather the chain of IFDs starting at IFD0.
+	var dirs []*tiff.Dir
+	seen := make(map[int64]bool)
+	decodeDir := func(off int64) (*tiff.Dir, int64, bool) {
+		if seen[off] || len(seen) >= maxRawIFDs {
+			return nil, 0, false
+		}
+		seen[off] = true
+		d, next, err := decodeTIFFDir(r, size, order, off)
+		return d, next, err == nil
+	}
+	for off := ifd0; ; {
+		d, next, ok := decodeDir(off)
+		if !ok {
+			break
+		}
+		dirs = append(dirs, d)
+		off = next
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("missing IFD0")
+	}
+
+	// Gather all SubIFDs.
+	for i := 0; i < len(dirs); i++ {
+		for _, tag := range dirs[i].Tags {
+			if tag.Id != tiffSubIFDs {
+				continue
+			}
+			for j := 0; j < int(tag.Count); j++ {
+				off, err := tag.Int64(j)
+				if err != nil {
+					continue
+				}
+				if d, _, ok := decodeDir(off); ok {
+					dirs = append(dirs, d)
+				}
+			}
+		}
+	}
+
+	// Locate the JPEG images referenced by each IFD.
+	var jpegs []*io.SectionReader
+	addJPEG := func(off, n int64) {
+		var soi [2]byte
+		if off > 0 && n > 2 && n <= size-off {
+			if _, err := r.ReadAt(soi[:], off); err == nil && soi == [2]byte{0xff, 0xd8} {
+				jpegs = append(jpegs, io.NewSectionReader(r, off, n))
+			}
+		}
+	}
+	for _, d := range dirs {
+		tags := make(map[uint16]*tiff.Tag)
+		for _, tag := range d.Tags {
+			tags[tag.Id] = tag
+		}
+		if off, n := tags[tiffJPEGInterchangeFormat], tags[tiffJPEGInterchangeFormatLength]; off != nil && n != nil {
+			off, err1 := off.Int64(0)
+			n, err2 := n.Int64(0)
+			if err1 == nil && err2 == nil {
+				addJPEG(off, n)
+			}
+		}
+		if c, off, n := tags[tiffCompression], tags[tiffStripOffsets], tags[tiffStripByteCounts]; c != nil && off != nil && n != nil && off.Count == 1 && n.Count == 1 {
+			if c, err := c.Int(0); err == nil && (c == 6 || c == 7) {
+				off, err1 := off.Int64(0)
+				n, err2 := n.Int64(0)
+				if err1 == nil && err2 == nil {
+					addJPEG(off, n)
+				}
+			}
+		}
+	}
+	sort.Slice(jpegs, func(i, j int) bool {
+		return jpegs[i].Size() < jpegs[j].Size()
+	})
+	return jpegs, nil
+}
+
+// rawEXIF returns a standalone TIFF file that contains only IFD0 and
+// the EXIF and GPS IFDs of a TIFF-based camera RAW file of the given size,
+// which is suitable for exif.Decode.
+func rawEXIF(r io.ReaderAt, size int64) ([]byte, error) {
+	order, off, err := readTIFFHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, _, err := decodeTIFFDir(r, size, order, off)
+	if err != nil {
+		return nil, fmt.Errorf("IFD0: %v", err)
+	}
+	subDir := func(id uint16) *tiff.Dir {
+		for _, tag := range ifd0.Tags {
+			if tag.Id == id {
+				if off, err := tag.Int64(0); err == nil {
+					if d, _, err := decodeTIFFDir(r, size, order, off); err == nil {
+						return d
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return encodeEXIFTIFF(order, ifd0, subDir(tiffExifIFD), subDir(tiffGPSIFD)), nil
+}
+
+// encodeEXIFTIFF encodes IFD0 and the EXIF and GPS IFDs (which may be nil)
+// as a TIFF file, where IFD0 points to the other IFDs.
+// Any other offsets (e.g., StripOffsets) are left as is.
+func encodeEXIFTIFF(order binary.ByteOrder, ifd0, exifDir, gpsDir *tiff.Dir) []byte {
+	filter := func(d *tiff.Dir, ids ...uint16) []*tiff.Tag {
+		var tags []*tiff.Tag
+	next:
+		for _, tag := range d.Tags {
+			for _, id := range ids {
+				if tag.Id == id {
+					continue next
+				}
+			}
+			tags = append(tags, tag)
+		}
+		return tags
+	}
+	pointer := func(id uint16) *tiff.Tag {
+		return &tiff.Tag{Id: id, Type: tiff.DTLong, Count: 1, Val: make([]byte, 4)}
+	}
+
+	// Gather the tags of every IFD, where the pointers are populated below.
+	dirs := [][]*tiff.Tag{filter(ifd0, tiffExifIFD, tiffGPSIFD)}
+	var pointers []*tiff.Tag
+	for _, sub := range []struct {
+		id   uint16
+		dir  *tiff.Dir
+		omit []uint16
+	}{{tiffExifIFD, exifDir, []uint16{tiffInteropIFD}}, {tiffGPSIFD, gpsDir, nil}} {
+		if sub.dir != nil {
+			ptr := pointer(sub.id)
+			dirs[0] = append(dirs[0], ptr)
+			pointers = append(pointers, ptr)
+			dirs = append(dirs, filter(sub.dir, sub.omit...))
+		}
+	}
+	sort.Slice(dirs[0], func(i, j int) bool { return dirs[0][i].Id < dirs[0][j].Id })
+
+	// Compute the offset of every IFD, where values larger than
+	// four bytes are stored (word-aligned) immediately after each IFD.
+	padLen := func(n int) int { return n + n%2 }
+	offs := make([]int, len(dirs))
+	off := 8
+	for i, tags := range dirs {
+		offs[i] = off
+		off += 2 + 12*len(tags) + 4
+		for _, tag := range tags {
+			if len(tag.Val) > 4 {
+				off += padLen(len(tag.Val))
+			}
+		}
+	}
+	for i, ptr := range pointers {
+		order.PutUint32(ptr.Val, uint32(offs[i+1]))
+	}
+
+	// Encode the TIFF header and every IFD.
+	b := make([]byte, off)
+	copy(b, "II*\x00")
+	if order == binary.BigEndian {
+		copy(b, "MM\x00*")
+	}
+	order.PutUint32(b[4:], uint32(offs[0]))
+	for i, tags := range dirs {
+		pos := offs[i]
+		data := pos + 2 + 12*len(tags) + 4
+		order.PutUint16(b[pos:], uint16(len(tags)))
+		pos += 2
+		for _, tag := range tags {
+			order.PutUint16(b[pos:], tag.Id)
+			order.PutUint16(b[pos+2:], uint16(tag.Type))
+			order.PutUint32(b[pos+4:], tag.Count)
+			if len(tag.Val) > 4 {
+				order.PutUint32(b[pos+8:], uint32(data))
+				copy(b[data:], tag.Val)
+				data += padLen(len(tag.Val))
+			} else {
+				copy(b[pos+8:pos+12], tag.Val)
+			}
+			pos += 12
+		}
+		// The next IFD offset is zero.
+	}
+	return b
+}
+
+// readTIFFHeader reads the TIFF header, returning the byte order
+// and the offset of IFD0.
+func readTIFFHeader(r io.ReaderAt) (binary.ByteOrder, int64, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, 0, err
+	}
+	var order binary.ByteOrder
+	switch string(hdr[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("invalid TIFF header")
+	}
+	return order, int64(order.Uint32(hdr[4:])), nil
+}
+
+// decodeTIFFDir decodes the IFD at off within a TIFF file of the given size,
+// returning the IFD and the offset of the next IFD.
+// Only the IFD and its tag values are read.
+func decodeTIFFDir(r io.ReaderAt, size int64, order binary.ByteOrder, off int64) (*tiff.Dir, int64, error) {
+	if off <= 0 || off >= size {
+		return nil, 0, errors.New("IFD out of range")
+	}
+	d, next, err := tiff.DecodeDir(&tiffDirReader{r, off}, order)
+	return d, int64(uint32(next)), err
+}
+
+// tiffDirReader reads an IFD sequentially starting at off,
+// while tag values are read at offsets relative to the start of the file.
+type tiffDirReader struct {
+	io.ReaderAt
+	off int64
+}
+
+func (r *tiffDirReader) Read(b []byte) (int, error) {
+	n, err := r.ReadAt(b, r.off)
+	r.off += int64(n)
+	if n == len(b) {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,374 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// tiffEntry is an IFD entry whose value fits within the value offset field.
+type tiffEntry struct {
+	id, typ uint16
+	count   uint32
+	value   uint32
+}
+
+// tiffFile builds a TIFF file from a sequence of blobs placed back-to-back
+// after the 8-byte header. The layout function is called with the offset
+// of every blob (which are computed from their lengths) and returns the
+// blobs. IFD0 is the blob at index ifd0. It returns the file and the offsets.
+func tiffFile(order binary.AppendByteOrder, ifd0 int, layout func(offs []uint32) [][]byte) ([]byte, []uint32) {
+	blobs := layout(make([]uint32, 64))
+	offs := make([]uint32, len(blobs))
+	off := uint32(8)
+	for i, b := range blobs {
+		offs[i] = off
+		off += uint32(len(b))
+	}
+	blobs = layout(offs)
+	hdr := []byte("II*\x00")
+	if order == binary.BigEndian {
+		hdr = []byte("MM\x00*")
+	}
+	hdr = order.AppendUint32(hdr, offs[ifd0])
+	return concat(append([][]byte{hdr}, blobs...)...), offs
+}
+
+// tiffIFD encodes an IFD with the given entries and next IFD offset.
+func tiffIFD(order binary.AppendByteOrder, next uint32, entries ...tiffEntry) []byte {
+	b := order.AppendUint16(nil, uint16(len(entries)))
+	for _, e := range entries {
+		b = order.AppendUint16(b, e.id)
+		b = order.AppendUint16(b, e.typ)
+		b = order.AppendUint32(b, e.count)
+		if e.typ == 3 && e.count == 1 {
+			b = order.AppendUint16(b, uint16(e.value))
+			b = order.AppendUint16(b, 0)
+		} else {
+			b = order.AppendUint32(b, e.value)
+		}
+	}
+	return order.AppendUint32(b, next)
+}
+
+func long(id uint16, v uint32) tiffEntry  { return tiffEntry{id, 4, 1, v} }
+func short(id uint16, v uint32) tiffEntry { return tiffEntry{id, 3, 1, v} }
+
+// fakeJPEG returns n bytes that start with a JPEG start-of-image marker.
+func fakeJPEG(n int) []byte {
+	b := bytes.Repeat([]byte{byte(n)}, n)
+	b[0], b[1] = 0xff, 0xd8
+	return b
+}
+
+func TestRawEmbeddedJPEGs(t *testing.T) {
+	le, be := binary.AppendByteOrder(binary.LittleEndian), binary.AppendByteOrder(binary.BigEndian)
+	type span struct{ off, n int64 }
+	type fixture func() ([]byte, []uint32)
+	file := func(order binary.AppendByteOrder, layout func(offs []uint32) [][]byte) fixture {
+		return func() ([]byte, []uint32) { return tiffFile(order, 0, layout) }
+	}
+	raw := func(b []byte) fixture {
+		return func() ([]byte, []uint32) { return b, nil }
+	}
+	tests := []struct {
+		name    string
+		in      fixture
+		want    func(offs []uint32) []span
+		wantErr bool
+	}{{
+		name: "InterchangeFormat",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, 0, long(tiffJPEGInterchangeFormat, offs[1]), long(tiffJPEGInterchangeFormatLength, 100)),
+				fakeJPEG(100),
+			}
+		}),
+		want: func(offs []uint32) []span { return []span{{int64(offs[1]), 100}} },
+	}, {
+		name: "SubIFDStripBigEndian",
+		in: file(be, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(be, 0, long(tiffSubIFDs, offs[1])),
+				tiffIFD(be, 0, short(tiffCompression, 7), long(tiffStripOffsets, offs[2]), long(tiffStripByteCounts, 50)),
+				fakeJPEG(50),
+			}
+		}),
+		want: func(offs []uint32) []span { return []span{{int64(offs[2]), 50}} },
+	}, {
+		name: "MultipleSubIFDs",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, 0, tiffEntry{tiffSubIFDs, 4, 2, offs[1]}),
+				le.AppendUint32(le.AppendUint32(nil, offs[2]), offs[3]),
+				tiffIFD(le, 0, short(tiffCompression, 6), long(tiffStripOffsets, offs[4]), long(tiffStripByteCounts, 300)),
+				tiffIFD(le, 0, long(tiffJPEGInterchangeFormat, offs[5]), long(tiffJPEGInterchangeFormatLength, 20)),
+				fakeJPEG(300),
+				fakeJPEG(20),
+			}
+		}),
+		want: func(offs []uint32) []span { return []span{{int64(offs[5]), 20}, {int64(offs[4]), 300}} },
+	}, {
+		name: "IFD1Chain",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, offs[1], short(tiffCompression, 1)),
+				tiffIFD(le, 0, long(tiffJPEGInterchangeFormat, offs[2]), long(tiffJPEGInterchangeFormatLength, 10)),
+				fakeJPEG(10),
+			}
+		}),
+		want: func(offs []uint32) []span { return []span{{int64(offs[2]), 10}} },
+	}, {
+		name: "UncompressedStrip",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, 0, short(tiffCompression, 1), long(tiffStripOffsets, offs[1]), long(tiffStripByteCounts, 10)),
+				fakeJPEG(10),
+			}
+		}),
+		want: func(offs []uint32) []span { return nil },
+	}, {
+		name: "NotJPEG",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, 0, long(tiffJPEGInterchangeFormat, offs[1]), long(tiffJPEGInterchangeFormatLength, 10)),
+				make([]byte, 10),
+			}
+		}),
+		want: func(offs []uint32) []span { return nil },
+	}, {
+		name: "OversizedLength",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, 0, long(tiffJPEGInterchangeFormat, offs[1]), long(tiffJPEGInterchangeFormatLength, 1<<31)),
+				fakeJPEG(10),
+			}
+		}),
+		want: func(offs []uint32) []span { return nil },
+	}, {
+		name: "ZeroOffset",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, 0, long(tiffJPEGInterchangeFormat, 0), long(tiffJPEGInterchangeFormatLength, 10)),
+			}
+		}),
+		want: func(offs []uint32) []span { return nil },
+	}, {
+		name: "CyclicIFDs",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{
+				tiffIFD(le, offs[0], long(tiffSubIFDs, offs[0]), long(tiffJPEGInterchangeFormat, offs[1]), long(tiffJPEGInterchangeFormatLength, 10)),
+				fakeJPEG(10),
+			}
+		}),
+		want: func(offs []uint32) []span { return []span{{int64(offs[1]), 10}} },
+	}, {
+		name: "SubIFDOutOfRange",
+		in: file(le, func(offs []uint32) [][]byte {
+			return [][]byte{tiffIFD(le, 0, long(tiffSubIFDs, 1<<30))}
+		}),
+		want: func(offs []uint32) []span { return nil },
+	}, {
+		name:    "InvalidHeader",
+		in:      raw([]byte("GIF89a\x00\x00\x00\x00")),
+		wantErr: true,
+	}, {
+		name:    "TruncatedHeader",
+		in:      raw([]byte("II*\x00")),
+		wantErr: true,
+	}, {
+		name:    "TruncatedIFD0",
+		in:      raw([]byte("II*\x00\x08\x00\x00\x00\x05\x00")),
+		wantErr: true,
+	}, {
+		name:    "IFD0OutOfRange",
+		in:      raw([]byte("II*\x00\xff\x00\x00\x00")),
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, offs := tt.in()
+			jpegs, err := rawEmbeddedJPEGs(bytes.NewReader(b), int64(len(b)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rawEmbeddedJPEGs error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got, want [][]byte
+			for _, jr := range jpegs {
+				jb, err := io.ReadAll(jr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, jb)
+			}
+			for _, s := range tt.want(offs) {
+				want = append(want, b[s.off:s.off+s.n])
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("rawEmbeddedJPEGs = %x, want %x", got, want)
+			}
+		})
+	}
+
+	// Every truncation of a valid file must fail gracefully.
+	t.Run("Truncated", func(t *testing.T) {
+		b, _ := tests[2].in()
+		for i := 0; i < len(b); i++ {
+			rawEmbeddedJPEGs(bytes.NewReader(b[:i]), int64(i))
+		}
+	})
+}
+
+func TestComputeRawPreview(t *testing.T) {
+	encode := func(w, h int) []byte {
+		var bb bytes.Buffer
+		if err := jpeg.Encode(&bb, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+			t.Fatal(err)
+		}
+		return bb.Bytes()
+	}
+	small, large := encode(40, 30), encode(400, 200)
+	le := binary.LittleEndian
+	b, _ := tiffFile(le, 0, func(offs []uint32) [][]byte {
+		return [][]byte{
+			tiffIFD(le, offs[1], long(tiffJPEGInterchangeFormat, offs[2]), long(tiffJPEGInterchangeFormatLength, uint32(len(small)))),
+			tiffIFD(le, 0, short(tiffCompression, 6), long(tiffStripOffsets, offs[3]), long(tiffStripByteCounts, uint32(len(large)))),
+			small,
+			large,
+		}
+	})
+	fp := filepath.Join(t.TempDir(), "IMG_0001.CR2")
+	if err := os.WriteFile(fp, b, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	// The smallest JPEG that is at least as large as the preview is used.
+	for _, tt := range []struct{ height, width int }{{20, 27}, {160, 320}} {
+		height := tt.height
+		var item Item
+		if err := computeRawPreview(context.Background(), &item, fp, height); err != nil {
+			t.Fatalf("computeRawPreview error: %v", err)
+		}
+		_, data, err := decodeDataURI(item.PreviewSrc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != image.Pt(tt.width, height) {
+			t.Errorf("preview size = %v, want %v", got, image.Pt(tt.width, height))
+		}
+	}
+
+	// A RAW file without any embedded JPEG has no preview.
+	b, _ = tiffFile(le, 0, func(offs []uint32) [][]byte {
+		return [][]byte{tiffIFD(le, 0, short(tiffCompression, 1))}
+	})
+	if err := os.WriteFile(fp, b, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := computeRawPreview(context.Background(), new(Item), fp, 160); err == nil {
+		t.Errorf("computeRawPreview succeeded, want error")
+	}
+}
+
+// countingReaderAt counts the number of bytes read.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (r *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(b, off)
+	r.n += int64(n)
+	return n, err
+}
+
+func TestLoadRawMetadata(t *testing.T) {
+	ascii := func(s string) []byte { return append([]byte(s), 0) }
+	make_, model := ascii("Canon"), ascii("Canon EOS R5")
+	dateTime, offsetTime := ascii("2021:07:04 10:00:00"), ascii("+09:00")
+	const pixelsSize = 4 << 20
+	for _, order := range []binary.AppendByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			b, _ := tiffFile(order, 0, func(offs []uint32) [][]byte {
+				return [][]byte{
+					tiffIFD(order, 0,
+						tiffEntry{0x010f, 2, uint32(len(make_)), offs[3]}, // Make
+						tiffEntry{0x0110, 2, uint32(len(model)), offs[4]}, // Model
+						short(0x0112, 6), // Orientation
+						long(tiffStripOffsets, offs[7]),
+						long(tiffExifIFD, offs[1]),
+						long(tiffGPSIFD, offs[2]),
+					),
+					tiffIFD(order, 0,
+						tiffEntry{0x9003, 2, uint32(len(dateTime)), offs[5]},   // DateTimeOriginal
+						tiffEntry{0x9011, 2, uint32(len(offsetTime)), offs[6]}, // OffsetTimeOriginal
+						long(tiffInteropIFD, 1<<30),
+					),
+					tiffIFD(order, 0, tiffEntry{0x0000, 1, 4, 0x02020000}), // GPSVersionID
+					make_, model, dateTime, offsetTime,
+					make([]byte, pixelsSize),
+				}
+			})
+
+			// Only the IFDs are read, rather than the pixel data.
+			cr := &countingReaderAt{r: bytes.NewReader(b)}
+			if _, err := rawEXIF(cr, int64(len(b))); err != nil {
+				t.Fatalf("rawEXIF error: %v", err)
+			}
+			if cr.n > 1024 {
+				t.Errorf("rawEXIF read %d bytes, want at most 1024", cr.n)
+			}
+
+			fp := filepath.Join(t.TempDir(), "IMG_0001.CR2")
+			if err := os.WriteFile(fp, b, 0664); err != nil {
+				t.Fatal(err)
+			}
+			item := Item{loc: time.UTC}
+			if err := loadRawMetadata(context.Background(), &item, fp); err != nil {
+				t.Fatalf("loadRawMetadata error: %v", err)
+			}
+			want := time.Date(2021, 7, 4, 10, 0, 0, 0, time.FixedZone("", 9*3600))
+			if got := item.MediaCreate; !got.Equal(want) || got.Format(time.RFC3339) != want.Format(time.RFC3339) {
+				t.Errorf("MediaCreate = %v, want %v", got, want)
+			}
+			if item.CameraMake != "Canon" || item.CameraModel != "Canon EOS R5" {
+				t.Errorf("camera = %q %q, want %q %q", item.CameraMake, item.CameraModel, "Canon", "Canon EOS R5")
+			}
+			if item.orientImage == nil {
+				t.Errorf("orientation was not loaded")
+			} else if got := item.orientImage(image.NewGray(image.Rect(0, 0, 4, 2))).Bounds().Size(); got != image.Pt(2, 4) {
+				t.Errorf("oriented size = %v, want %v", got, image.Pt(2, 4))
+			}
+		})
+	}
+
+	// Every truncation of a valid file must fail gracefully.
+	t.Run("Truncated", func(t *testing.T) {
+		b := exifTIFF("2021:07:04 10:00:00")
+		for i := 0; i < len(b); i++ {
+			if eb, err := rawEXIF(bytes.NewReader(b[:i]), int64(i)); err == nil {
+				exif.Decode(bytes.NewReader(eb))
+			}
+		}
+	})
+}
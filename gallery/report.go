@@ -0,0 +1,103 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Item statuses reported in an ItemReport.
+const (
+	StatusCached     = "cached"      // reused from the previous gallery
+	StatusDiskCached = "disk_cached" // reused from the persistent cache
+	StatusProcessed  = "processed"   // newly processed
+	StatusFailed     = "failed"      // processed (now or previously) with errors
+	StatusTimedOut   = "timed_out"   // processing took too long
+	StatusExcluded   = "excluded"    // matched the exclude pattern
+	StatusUnfinished = "unfinished"  // not processed before being interrupted
+)
+
+// Report is a machine-readable summary of generating a gallery.
+type Report struct {
+	// Start is when generation started.
+	Start time.Time
+	// Seconds is how long generation took.
+	Seconds float64
+	// Counts are the number of items for each status.
+	Counts map[string]int
+	// Items are reports for every media file that was considered.
+	Items []ItemReport
+	// Duplicates are the file paths of every set of duplicate media
+	// (if detected), where the preferred file is first.
+	Duplicates [][]string `json:",omitempty"`
+}
+
+// ItemReport is a summary of processing a single media file.
+type ItemReport struct {
+	// Path is the file path of the media file.
+	Path string
+	// Status is one of the Status constants.
+	Status string
+	// Error is the reason why processing failed (if any).
+	Error string `json:",omitempty"`
+	// Seconds is how long processing took.
+	Seconds float64
+	// Commands are the child processes (e.g., ffmpeg) that were run.
+	Commands []CommandReport `json:",omitempty"`
+	// PreviewBytes is the size of the preview image in bytes.
+	PreviewBytes int `json:",omitempty"`
+}
+
+// CommandReport is a summary of running a child process.
+type CommandReport struct {
+	// Name is the name of the program (e.g., "ffmpeg").
+	Name string
+	// Seconds is how long the process ran.
+	Seconds float64
+}
+
+// add adds item reports to the report.
+func (r *Report) add(items ...ItemReport) {
+	if r == nil {
+		return
+	}
+	if r.Counts == nil {
+		r.Counts = make(map[string]int)
+	}
+	for _, item := range items {
+		r.Counts[item.Status]++
+	}
+	r.Items = append(r.Items, items...)
+}
+
+// addDuplicates adds a set of duplicate media files to the report.
+func (r *Report) addDuplicates(paths []string) {
+	if r == nil {
+		return
+	}
+	r.Duplicates = append(r.Duplicates, paths)
+}
+
+// WriteFile atomically writes the report as JSON to the file at fp.
+func (r *Report) WriteFile(fp string) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fp, append(b, '\n'), 0664)
+}
+
+// previewBytes returns the size of a data URI preview in bytes.
+// External previews are not counted.
+func previewBytes(src string) int {
+	i := strings.Index(src, ";base64,")
+	if !strings.HasPrefix(src, "data:") || i < 0 {
+		return 0
+	}
+	n := len(strings.TrimSpace(src[i+len(";base64,"):]))
+	return n/4*3 - strings.Count(src[len(src)-2:], "=")
+}
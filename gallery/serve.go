@@ -0,0 +1,72 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Handler returns an HTTP handler that serves the gallery for dir along with
+// the media files within dir, where URL paths are relative to the parent of dir.
+// The gallery is regenerated (see Generate) whenever its first page is requested.
+// Files are served with http.FileServer, which supports range requests.
+func Handler(dir string, opts Options) http.Handler {
+	dir = filepath.Clean(dir)
+	root := filepath.Dir(dir)
+	return &galleryHandler{
+		dir:     dir,
+		dirName: filepath.Base(dir),
+		opts:    opts,
+		files:   http.FileServer(http.Dir(root)),
+	}
+}
+
+type galleryHandler struct {
+	dir     string
+	dirName string
+	opts    Options
+	files   http.Handler
+
+	mu sync.Mutex // serializes gallery generation
+}
+
+func (h *galleryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Path)
+	switch {
+	case p == "/":
+		http.Redirect(w, r, (&url.URL{Path: "/" + h.dirName + ".html"}).String(), http.StatusFound)
+	case p == "/"+h.dirName+".html":
+		h.mu.Lock()
+		err := Generate(r.Context(), h.dir, h.opts)
+		h.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.files.ServeHTTP(w, r)
+	case h.isPage(p),
+		strings.HasPrefix(p, "/"+h.dirName+"/"),
+		strings.HasPrefix(p, "/"+thumbsDirName(h.dirName)+"/"):
+		h.files.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r) // avoid serving other files in the parent directory
+	}
+}
+
+// isPage reports whether p is the URL path of a subsequent page of the gallery.
+func (h *galleryHandler) isPage(p string) bool {
+	s := strings.TrimPrefix(p, "/"+h.dirName+"-")
+	if s == p || !strings.HasSuffix(s, ".html") {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(s, ".html"))
+	return err == nil && n >= 2
+}
@@ -0,0 +1,90 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// ClockSkew is a correction for media captured by a device with an
+// incorrect clock. Exactly one of Camera or Path must be specified.
+type ClockSkew struct {
+	// Camera matches media whose EXIF camera model, or make and model
+	// separated by a space, is equal to Camera (ignoring case).
+	Camera string `json:",omitempty"`
+	// Path is a path.Match pattern that matches media paths.
+	// Paths are matched as forward-slash separated paths with a leading slash.
+	Path string `json:",omitempty"`
+	// Offset is the duration added to the media creation time.
+	Offset time.Duration
+}
+
+// ParseClockSkew parses a clock skew of the form "camera:MODEL=OFFSET" or
+// "path:PATTERN=OFFSET", where OFFSET is parsed by time.ParseDuration.
+// For example, "camera:Canon EOS 80D=+1h30m" or "path:/pics/dad/*=-5m".
+func ParseClockSkew(s string) (ClockSkew, error) {
+	var cs ClockSkew
+	i := strings.LastIndexByte(s, '=')
+	if i < 0 {
+		return cs, errors.New("missing offset")
+	}
+	offset, err := time.ParseDuration(s[i+1:])
+	if err != nil {
+		return cs, err
+	}
+	cs.Offset = offset
+	kind, pattern := s[:i], ""
+	if j := strings.IndexByte(kind, ':'); j >= 0 {
+		kind, pattern = kind[:j], kind[j+1:]
+	}
+	switch {
+	case kind == "camera" && pattern != "":
+		cs.Camera = pattern
+	case kind == "path" && pattern != "":
+		if _, err := path.Match(pattern, ""); err != nil {
+			return cs, err
+		}
+		cs.Path = pattern
+	default:
+		return cs, errors.New(`must match "camera:MODEL=OFFSET" or "path:PATTERN=OFFSET"`)
+	}
+	return cs, nil
+}
+
+// String formats the clock skew in the form accepted by ParseClockSkew.
+func (cs ClockSkew) String() string {
+	offset := cs.Offset.String()
+	if cs.Offset >= 0 {
+		offset = "+" + offset
+	}
+	if cs.Camera != "" {
+		return "camera:" + cs.Camera + "=" + offset
+	}
+	return "path:" + cs.Path + "=" + offset
+}
+
+// matches reports whether the clock skew applies to the item,
+// where fp is the path of the item matched against the Path pattern.
+func (cs ClockSkew) matches(item *Item, fp string) bool {
+	if cs.Camera != "" {
+		return strings.EqualFold(cs.Camera, item.CameraModel) ||
+			strings.EqualFold(cs.Camera, strings.TrimSpace(item.CameraMake+" "+item.CameraModel))
+	}
+	ok, _ := path.Match(cs.Path, fp)
+	return ok
+}
+
+// clockSkew returns the offset of the first clock skew that applies to the item.
+func clockSkew(skews []ClockSkew, item *Item, fp string) time.Duration {
+	for _, cs := range skews {
+		if cs.matches(item, fp) {
+			return cs.Offset
+		}
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// previewExts maps the MIME type of a preview to the file extension
+// used for external preview files.
+var previewExts = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+}
+
+// encodeDataURI encodes data as a base64 data URI.
+func encodeDataURI(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64, " + base64.StdEncoding.EncodeToString(data)
+}
+
+// decodeDataURI decodes a base64 data URI produced by encodeDataURI.
+func decodeDataURI(s string) (mimeType string, data []byte, err error) {
+	i := strings.Index(s, ";base64,")
+	if !strings.HasPrefix(s, "data:") || i < 0 {
+		return "", nil, errors.New("invalid data URI")
+	}
+	data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s[i+len(";base64,"):]))
+	return s[len("data:"):i], data, err
+}
+
+// placeholderPreview returns an SVG preview image of the specified pixel
+// height for media that could not be processed, which shows the file name
+// and the reason why (truncated to fit).
+func placeholderPreview(name, reason string, height int) string {
+	if r := []rune(reason); len(r) > 40 {
+		reason = string(r[:39]) + "…"
+	}
+	w, h := strconv.Itoa(2*height), strconv.Itoa(height)
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="` + w + `" height="` + h + `" font-family="sans-serif" font-size="12" text-anchor="middle">` +
+		`<rect width="100%" height="100%" fill="#ddd"/>` +
+		`<text x="50%" y="45%">` + html.EscapeString(name) + `</text>` +
+		`<text x="50%" y="60%" fill="#a00">` + html.EscapeString(reason) + `</text>` +
+		`</svg>`
+	return encodeDataURI("image/svg+xml", []byte(svg))
+}
+
+// isPlaceholderPreview reports whether src is a preview produced by
+// placeholderPreview, either as a data URI or as an external preview file.
+func isPlaceholderPreview(src string) bool {
+	return strings.HasPrefix(src, "data:image/svg+xml;") || path.Ext(src) == ".svg"
+}
+
+// errorReason returns the first line of an error message,
+// truncated to a reasonable length for storing in a gallery page.
+func errorReason(msg string) string {
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = strings.TrimSpace(msg[:i])
+	}
+	if r := []rune(msg); len(r) > 200 {
+		msg = string(r[:199]) + "…"
+	}
+	return msg
+}
+
+// thumbsDirName returns the name of the directory holding the external
+// previews for the gallery of the named directory.
+func thumbsDirName(dirName string) string {
+	return dirName + ".thumbs"
+}
+
+// isThumbsDir reports whether fp is a directory of external previews
+// for a sibling directory.
+func isThumbsDir(fp string) bool {
+	if !strings.HasSuffix(fp, ".thumbs") {
+		return false
+	}
+	fi, err := os.Stat(strings.TrimSuffix(fp, ".thumbs"))
+	return err == nil && fi.IsDir()
+}
+
+// writeExternalPreview writes a data URI preview to a file named after the
+// hash of its content within the thumbs directory for the named directory.
+// It returns the forward-slash separated path of the file relative to root.
+func writeExternalPreview(root, dirName, src string) (string, error) {
+	mimeType, data, err := decodeDataURI(src)
+	if err != nil {
+		return "", err
+	}
+	ext, ok := previewExts[mimeType]
+	if !ok {
+		return "", fmt.Errorf("unsupported preview type: %v", mimeType)
+	}
+	hash := sha256.Sum256(data)
+	name := path.Join(thumbsDirName(dirName), hex.EncodeToString(hash[:16])+ext)
+	fp := filepath.Join(root, filepath.FromSlash(name))
+	if _, err := os.Stat(fp); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(fp), 0775); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(fp, data, 0664); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// readExternalPreview reads a preview file previously written by
+// writeExternalPreview and returns it as a data URI.
+func readExternalPreview(root, dirName, src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	if path.Dir(u.Path) != thumbsDirName(dirName) {
+		return "", fmt.Errorf("preview not in %v: %v", thumbsDirName(dirName), src)
+	}
+	for mimeType, ext := range previewExts {
+		if path.Ext(u.Path) == ext {
+			data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(u.Path)))
+			if err != nil {
+				return "", err
+			}
+			return encodeDataURI(mimeType, data), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported preview file: %v", src)
+}
+
+// removeUnusedPreviews removes preview files within the thumbs directory
+// for the named directory that are not in used.
+// The thumbs directory itself is removed if it becomes empty.
+func removeUnusedPreviews(root, dirName string, used map[string]bool) (removed int, err error) {
+	dir := filepath.Join(root, thumbsDirName(dirName))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return 0, err
+	}
+	var remaining int
+	for _, e := range entries {
+		name := path.Join(thumbsDirName(dirName), e.Name())
+		if used[name] || !isPreviewName(e.Name()) {
+			remaining++
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	if remaining == 0 {
+		return removed, os.Remove(dir)
+	}
+	return removed, nil
+}
+
+// isPreviewName reports whether name is the name of a preview file
+// written by writeExternalPreview.
+func isPreviewName(name string) bool {
+	ext := path.Ext(name)
+	b, err := hex.DecodeString(strings.TrimSuffix(name, ext))
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	for _, e := range previewExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
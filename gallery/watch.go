@@ -0,0 +1,132 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is how long the directory tree must be free of changes
+// before the gallery is regenerated.
+const watchDelay = 2 * time.Second
+
+// Watch generates the gallery for dir (see Generate) and then watches
+// the directory tree for changes, regenerating the gallery after every
+// burst of changes. It runs until the context is canceled, after which
+// it returns nil unless the initial generation was interrupted.
+// Interrupting a later regeneration leaves a partial gallery (see Generate),
+// which is resumed by the next run.
+func Watch(ctx context.Context, dir string, opts Options) error {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	dir = filepath.Clean(dir)
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := watchTree(w, dir); err != nil {
+		return err
+	}
+
+	if err := Generate(ctx, dir, opts); err != nil {
+		return err
+	}
+	logger.Info("watching for changes", "dir", dir)
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			if isGeneratedFile(ev.Name) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					if err := watchTree(w, ev.Name); err != nil {
+						logger.Warn("watchTree error", "error", err)
+					}
+				}
+			}
+			resetTimer(timer, watchDelay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			logger.Warn("watcher error", "error", err)
+			resetTimer(timer, watchDelay) // events may have been dropped
+		case <-timer.C:
+			if err := Generate(ctx, dir, opts); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				var oe *OptionError
+				if errors.As(err, &oe) {
+					return err
+				}
+				logger.Error("Generate error", "error", err)
+			}
+		}
+	}
+}
+
+// resetTimer resets t to expire after d, discarding any expiration that
+// has not been received yet (which Timer.Reset does not do prior to Go 1.23),
+// so that a burst of changes does not trigger regeneration before it ends.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// watchTree adds dir and all of its subdirectories to the watcher,
+// except for directories of external previews.
+func watchTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed since the event
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if isThumbsDir(fp) {
+			return filepath.SkipDir
+		}
+		return w.Add(fp)
+	})
+}
+
+// isGeneratedFile reports whether fp is a file that may be written while
+// generating a gallery, such that changes to it must not trigger regeneration.
+func isGeneratedFile(fp string) bool {
+	name := filepath.Base(fp)
+	return strings.HasSuffix(name, ".html") ||
+		strings.HasSuffix(name, ".tmp") ||
+		isThumbsDir(fp) || isThumbsDir(filepath.Dir(fp))
+}
@@ -0,0 +1,32 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResetTimer(t *testing.T) {
+	// A timer that expired without being received must not fire early.
+	timer := time.NewTimer(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	resetTimer(timer, time.Hour)
+	select {
+	case <-timer.C:
+		t.Fatal("timer fired with a stale expiration")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A timer that is already drained or still pending is simply reset.
+	resetTimer(timer, time.Millisecond)
+	<-timer.C
+	resetTimer(timer, time.Millisecond)
+	select {
+	case <-timer.C:
+	case <-time.After(time.Minute):
+		t.Fatal("timer did not fire")
+	}
+}
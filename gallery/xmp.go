@@ -0,0 +1,53 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"regexp"
+	"time"
+)
+
+// xmpDateProperties are the XMP properties that may hold the creation time
+// of the media, in order of precedence.
+var xmpDateProperties = []*regexp.Regexp{
+	xmpPropertyRegexp("exif:DateTimeOriginal"),
+	xmpPropertyRegexp("photoshop:DateCreated"),
+	xmpPropertyRegexp("xmp:CreateDate"),
+}
+
+// xmpPropertyRegexp matches a simple XMP property specified either
+// as an attribute (e.g., `xmp:CreateDate="..."`) or
+// as an element (e.g., `<xmp:CreateDate>...</xmp:CreateDate>`).
+func xmpPropertyRegexp(name string) *regexp.Regexp {
+	name = regexp.QuoteMeta(name)
+	return regexp.MustCompile(`\b` + name + `\s*=\s*["']([^"']*)["']|<` + name + `>([^<]*)</` + name + `>`)
+}
+
+// xmpDateLayouts are the date formats permitted by XMP (a subset of ISO 8601).
+var xmpDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// xmpDateTime returns the creation time specified in an XMP packet.
+// Timestamps without a time zone are interpreted in the provided location.
+func xmpDateTime(b []byte, loc *time.Location) (time.Time, bool) {
+	for _, rx := range xmpDateProperties {
+		m := rx.FindSubmatch(b)
+		if m == nil {
+			continue
+		}
+		s := string(m[1]) + string(m[2])
+		for _, layout := range xmpDateLayouts {
+			if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,79 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package gallery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestXMPDateTime(t *testing.T) {
+	loc := time.FixedZone("", 9*3600)
+	tests := []struct {
+		name   string
+		in     string
+		want   time.Time
+		wantOK bool
+	}{{
+		name:   "Attribute",
+		in:     `<rdf:Description xmp:CreateDate="2021-07-04T10:00:00-07:00"/>`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 0, time.FixedZone("", -7*3600)),
+		wantOK: true,
+	}, {
+		name:   "SingleQuotedAttribute",
+		in:     `<rdf:Description xmp:CreateDate = '2021-07-04T10:00:00Z'/>`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 0, time.UTC),
+		wantOK: true,
+	}, {
+		name:   "Element",
+		in:     `<exif:DateTimeOriginal>2021-07-04T10:00:00.25+05:30</exif:DateTimeOriginal>`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 250e6, time.FixedZone("", 5*3600+1800)),
+		wantOK: true,
+	}, {
+		name:   "Precedence",
+		in:     `<rdf:Description xmp:CreateDate="2000-01-01T00:00:00Z" photoshop:DateCreated="2010-01-01T00:00:00Z"><exif:DateTimeOriginal>2021-07-04T10:00:00Z</exif:DateTimeOriginal></rdf:Description>`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 0, time.UTC),
+		wantOK: true,
+	}, {
+		name:   "WithoutTimeZone",
+		in:     `xmp:CreateDate="2021-07-04T10:00:00"`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 0, loc),
+		wantOK: true,
+	}, {
+		name:   "WithoutSeconds",
+		in:     `xmp:CreateDate="2021-07-04T10:00Z"`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 0, time.UTC),
+		wantOK: true,
+	}, {
+		name:   "DateOnly",
+		in:     `xmp:CreateDate="2021-07-04"`,
+		want:   time.Date(2021, 7, 4, 0, 0, 0, 0, loc),
+		wantOK: true,
+	}, {
+		name:   "SkipsInvalid",
+		in:     `exif:DateTimeOriginal="yesterday" xmp:CreateDate="2021-07-04T10:00:00Z"`,
+		want:   time.Date(2021, 7, 4, 10, 0, 0, 0, time.UTC),
+		wantOK: true,
+	}, {
+		name: "PrefixedName",
+		in:   `myxmp:CreateDate="2021-07-04T10:00:00Z"`,
+	}, {
+		name: "Invalid",
+		in:   `xmp:CreateDate="2021:07:04 10:00:00"`,
+	}, {
+		name: "Missing",
+		in:   `xmp:ModifyDate="2021-07-04T10:00:00Z"`,
+	}, {
+		name: "Empty",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := xmpDateTime([]byte(tt.in), loc)
+			if ok != tt.wantOK || !got.Equal(tt.want) || got.Format(time.RFC3339Nano) != tt.want.Format(time.RFC3339Nano) {
+				t.Errorf("xmpDateTime = (%v, %v), want (%v, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,8 +1,14 @@
 module github.com/dsnet/generate-gallery
 
-go 1.16
+go 1.21
 
 require (
 	github.com/disintegration/imaging v1.6.2
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 )
+
+require (
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+)